@@ -0,0 +1,203 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const _AGGREGATE_PAGE_SIZE = 1000
+
+//AggregateOptions describes a client-side aggregation over the rows of a collection
+type AggregateOptions struct {
+	//GroupBy is the column rows are grouped by. Leave empty to aggregate everything into a single group.
+	GroupBy string
+	//Columns are the numeric columns that sum, avg, min and max are computed for
+	Columns []string
+	//TimeColumn and Bucket group rows into time buckets of the given width, on top of GroupBy
+	TimeColumn string
+	Bucket     time.Duration
+	//PageSize is the number of rows fetched per request. Defaults to 1000.
+	PageSize int
+}
+
+//ColumnStats holds the running aggregates of a single column
+type ColumnStats struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+//Avg returns the mean of the values seen, or 0 if there were none
+func (cs *ColumnStats) Avg() float64 {
+	if cs.Count == 0 {
+		return 0
+	}
+	return cs.Sum / float64(cs.Count)
+}
+
+func (cs *ColumnStats) add(v float64) {
+	if cs.Count == 0 {
+		cs.Min, cs.Max = v, v
+	} else {
+		cs.Min = math.Min(cs.Min, v)
+		cs.Max = math.Max(cs.Max, v)
+	}
+	cs.Count++
+	cs.Sum += v
+}
+
+//AggregateGroup is the result for one group (and time bucket, when bucketing)
+type AggregateGroup struct {
+	Key     interface{}
+	Bucket  time.Time
+	Count   int
+	Columns map[string]*ColumnStats
+}
+
+//Aggregator computes grouped aggregates incrementally, one row at a time
+type Aggregator struct {
+	opts   AggregateOptions
+	groups map[string]*AggregateGroup
+}
+
+//NewAggregator allocates an Aggregator for the given options
+func NewAggregator(opts AggregateOptions) (*Aggregator, error) {
+	if opts.Bucket < 0 {
+		return nil, fmt.Errorf("Bucket must not be negative")
+	}
+	if opts.Bucket > 0 && opts.TimeColumn == "" {
+		return nil, fmt.Errorf("TimeColumn is required when bucketing by time")
+	}
+	return &Aggregator{
+		opts:   opts,
+		groups: map[string]*AggregateGroup{},
+	}, nil
+}
+
+//Add folds a row into the aggregates. Null values are ignored; non-numeric values are an error.
+func (a *Aggregator) Add(row map[string]interface{}) error {
+	var key interface{}
+	if a.opts.GroupBy != "" {
+		key = row[a.opts.GroupBy]
+	}
+	var bucket time.Time
+	if a.opts.Bucket > 0 {
+		t, err := ParseTimestamp(row[a.opts.TimeColumn])
+		if err != nil {
+			return fmt.Errorf("Column '%s': %s", a.opts.TimeColumn, err.Error())
+		}
+		bucket = t.Truncate(a.opts.Bucket)
+	}
+	//the key is encoded with its type, so that 1 and "1" are different groups
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("Column '%s': %s", a.opts.GroupBy, err.Error())
+	}
+	id := fmt.Sprintf("%d|%T|%s", bucket.UnixNano(), key, encoded)
+	grp, ok := a.groups[id]
+	if !ok {
+		grp = &AggregateGroup{
+			Key:     key,
+			Bucket:  bucket,
+			Columns: map[string]*ColumnStats{},
+		}
+		for _, col := range a.opts.Columns {
+			grp.Columns[col] = &ColumnStats{}
+		}
+		a.groups[id] = grp
+	}
+	grp.Count++
+	for _, col := range a.opts.Columns {
+		val, ok := row[col]
+		if !ok || val == nil {
+			continue
+		}
+		f, err := toFloat64(val)
+		if err != nil {
+			return fmt.Errorf("Column '%s': %s", col, err.Error())
+		}
+		grp.Columns[col].add(f)
+	}
+	return nil
+}
+
+//Results returns the groups ordered by time bucket, then by group key
+func (a *Aggregator) Results() []*AggregateGroup {
+	rval := make([]*AggregateGroup, 0, len(a.groups))
+	for _, grp := range a.groups {
+		rval = append(rval, grp)
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		if !rval[i].Bucket.Equal(rval[j].Bucket) {
+			return rval[i].Bucket.Before(rval[j].Bucket)
+		}
+		return fmt.Sprint(rval[i].Key) < fmt.Sprint(rval[j].Key)
+	})
+	return rval
+}
+
+//Aggregate pages through the rows of a collection that match query, and computes grouped aggregates over them.
+//query must have an Order on columns that identify rows uniquely, such as item_id, so that pages don't overlap.
+func (u *UserClient) Aggregate(collection_id string, query *Query, opts AggregateOptions) ([]*AggregateGroup, error) {
+	return aggregate(u, collection_id, query, opts)
+}
+
+//Aggregate pages through the rows of a collection that match query, and computes grouped aggregates over them.
+//query must have an Order on columns that identify rows uniquely, such as item_id, so that pages don't overlap.
+func (d *DeviceClient) Aggregate(collection_id string, query *Query, opts AggregateOptions) ([]*AggregateGroup, error) {
+	return aggregate(d, collection_id, query, opts)
+}
+
+//Aggregate pages through the rows of a collection that match query, and computes grouped aggregates over them.
+//query must have an Order on columns that identify rows uniquely, such as item_id, so that pages don't overlap.
+func (d *DevClient) Aggregate(collection_id string, query *Query, opts AggregateOptions) ([]*AggregateGroup, error) {
+	return aggregate(d, collection_id, query, opts)
+}
+
+func aggregate(c cbClient, collection_id string, query *Query, opts AggregateOptions) ([]*AggregateGroup, error) {
+	agg, err := NewAggregator(opts)
+	if err != nil {
+		return nil, err
+	}
+	//without a sort order rows can move between pages while paging, and be counted twice or not at all
+	if query == nil || len(query.Order) == 0 {
+		return nil, fmt.Errorf("Aggregate needs a query with an Order, to page through rows in a stable order")
+	}
+	page := NewQuery()
+	*page = *query
+	page.PageSize = opts.PageSize
+	if page.PageSize <= 0 {
+		page.PageSize = _AGGREGATE_PAGE_SIZE
+	}
+	for page.PageNumber = 1; ; page.PageNumber++ {
+		resp, err := getdata(c, collection_id, page)
+		if err != nil {
+			return nil, err
+		}
+		if resp["DATA"] == nil {
+			break
+		}
+		rows, ok := resp["DATA"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unexpected response from data endpoint: %+v", resp)
+		}
+		//a short page isn't the last one, the platform may cap the page size below what was asked for
+		if len(rows) == 0 {
+			break
+		}
+		for _, rowIF := range rows {
+			row, ok := rowIF.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected row to be a map, got %T", rowIF)
+			}
+			if err := agg.Add(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return agg.Results(), nil
+}
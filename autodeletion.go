@@ -22,11 +22,23 @@ type AutodeletionSettings struct {
 func unpackMapToAutodeletionSettings(m interface{}) (AutodeletionSettings, error) {
 	switch m := m.(type) {
 	case map[string]interface{}:
+		maxSize, err := toInt64(m["max_size_kb"])
+		if err != nil {
+			return AutodeletionSettings{}, err
+		}
+		maxRows, err := toInt64(m["max_rows"])
+		if err != nil {
+			return AutodeletionSettings{}, err
+		}
+		maxAge, err := toInt64(m["expiration_age_seconds"])
+		if err != nil {
+			return AutodeletionSettings{}, err
+		}
 		return AutodeletionSettings{
 			Enabled:       m["enabled"].(bool),
-			MaxSizeKb:     int(m["max_size_kb"].(float64)),
-			MaxRows:       int(m["max_rows"].(float64)),
-			MaxAgeSeconds: int64(m["expiration_age_seconds"].(float64)),
+			MaxSizeKb:     int(maxSize),
+			MaxRows:       int(maxRows),
+			MaxAgeSeconds: maxAge,
 		}, nil
 	default:
 		return AutodeletionSettings{}, fmt.Errorf("Unexpected response from Autodeletion Settings Endpoint: %+v", m)
@@ -0,0 +1,299 @@
+package GoSDK
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	//_BRIDGE_PUBLISH_TIMEOUT bounds how long a forwarded message waits for the destination broker
+	_BRIDGE_PUBLISH_TIMEOUT = 10 * time.Second
+	//_BRIDGE_QUEUE_SIZE is the number of messages waiting to be forwarded to one side before more are dropped
+	_BRIDGE_QUEUE_SIZE = 1000
+)
+
+//BridgeDirection says which way a BridgeRule forwards
+type BridgeDirection int
+
+const (
+	//BridgeAToB forwards messages received by the bridge's first client through its second
+	BridgeAToB BridgeDirection = iota
+	//BridgeBToA forwards messages received by the bridge's second client through its first
+	BridgeBToA
+)
+
+//BridgeRule selects messages to forward and rewrites their topics
+type BridgeRule struct {
+	//Filter is the topic filter subscribed to on the source side
+	Filter    string
+	Direction BridgeDirection
+	//From and To rewrite the leading topic levels: a topic whose first levels are From is forwarded with
+	//To in their place. An empty From puts To in front of every topic, an empty To removes From.
+	From string
+	To   string
+	//Qos is the maximum qos subscribed with. Messages are forwarded with the qos and retain flag they arrived with.
+	Qos int
+}
+
+//BridgeStats counts the messages a bridge has handled
+type BridgeStats struct {
+	Forwarded uint64
+	//Dropped counts messages that were not forwarded because their publish failed or timed out, because
+	//too many were waiting to be forwarded to the same side, or because the bridge was closed first
+	Dropped uint64
+}
+
+//MqttBridge forwards messages between two mqtt connections, which can be any kind of client, on the same or different brokers
+type MqttBridge struct {
+	a, b      MqttClient
+	routes    []*bridgeRoute
+	subs      []*Subscription
+	queues    map[MqttClient]chan *bridgeMessage
+	stop      chan struct{}
+	stopOnce  sync.Once
+	workers   sync.WaitGroup
+	forwarded uint64
+	dropped   uint64
+	//OnDrop is called with the topic and reason of each dropped message
+	OnDrop func(topic string, err error)
+}
+
+//bridgeMessage is a message waiting to be published to a side
+type bridgeMessage struct {
+	topic, target string
+	qos           byte
+	retain        bool
+	payload       []byte
+}
+
+type bridgeRoute struct {
+	filter   string
+	from, to string
+	qos      int
+	src, dst MqttClient
+	//srcSide names the source client, "a" or "b"
+	srcSide string
+}
+
+//NewMqttBridge subscribes for every rule and starts forwarding. Messages are queued for each side and
+//published in the order they arrived, so a slow broker doesn't hold up the connection they came in on.
+//
+//Only loops made by the rules themselves are prevented. Each direction has to forward to topics that no rule
+//forwarding the other way subscribes to, typically by giving each direction its own prefix, or messages would
+//go round in circles; rules that would are rejected. When both clients are on the same broker, rules must not
+//subscribe on one side to the topics they publish to on the other either. Messages carry nothing that marks
+//them as forwarded, so loops made outside the bridge, by another bridge or a client republishing forwarded
+//topics back, are not detected.
+func NewMqttBridge(a, b MqttClient, rules []BridgeRule) (*MqttBridge, error) {
+	if a == nil || b == nil {
+		return nil, fmt.Errorf("Both MqttClients are required")
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("At least one rule is required")
+	}
+	br := &MqttBridge{
+		a:      a,
+		b:      b,
+		queues: map[MqttClient]chan *bridgeMessage{},
+		stop:   make(chan struct{}),
+	}
+	for _, rule := range rules {
+		if err := ValidateTopicFilter(rule.Filter); err != nil {
+			return nil, err
+		}
+		route := &bridgeRoute{
+			filter: rule.Filter,
+			from:   strings.TrimSuffix(rule.From, "/"),
+			to:     strings.TrimSuffix(rule.To, "/"),
+			qos:    rule.Qos,
+		}
+		switch rule.Direction {
+		case BridgeAToB:
+			route.src, route.dst, route.srcSide = a, b, "a"
+		case BridgeBToA:
+			route.src, route.dst, route.srcSide = b, a, "b"
+		default:
+			return nil, fmt.Errorf("Unknown bridge direction %d", rule.Direction)
+		}
+		br.routes = append(br.routes, route)
+	}
+	for _, route := range br.routes {
+		for _, target := range route.targets() {
+			for _, back := range br.routes {
+				if back.src == route.dst && filtersOverlap(target, back.filter) {
+					return nil, fmt.Errorf("Rule forwarding '%s' publishes to '%s', which the rule forwarding '%s' back subscribes to", route.filter, target, back.filter)
+				}
+			}
+		}
+	}
+	for _, dst := range []MqttClient{a, b} {
+		if _, ok := br.queues[dst]; ok {
+			continue
+		}
+		queue := make(chan *bridgeMessage, _BRIDGE_QUEUE_SIZE)
+		br.queues[dst] = queue
+		br.workers.Add(1)
+		go br.publishQueued(dst, queue)
+	}
+	subscribed := map[string]bool{}
+	for _, route := range br.routes {
+		route := route
+		//a second subscription to the same filter would replace the first, which is the one that forwards anyway
+		key := route.srcSide + "|" + route.filter
+		if subscribed[key] {
+			continue
+		}
+		subscribed[key] = true
+		sub, err := subscribeWithOptions(route.src, route.filter, route.qos, SubscribeOptions{}, func(msg *mqttTypes.Publish) {
+			br.forward(route, msg)
+		})
+		if err != nil {
+			br.Close()
+			return nil, fmt.Errorf("Error subscribing to '%s': %v", route.filter, err)
+		}
+		br.subs = append(br.subs, sub)
+	}
+	return br, nil
+}
+
+//Stats returns the bridge's counters
+func (br *MqttBridge) Stats() BridgeStats {
+	return BridgeStats{
+		Forwarded: atomic.LoadUint64(&br.forwarded),
+		Dropped:   atomic.LoadUint64(&br.dropped),
+	}
+}
+
+//Close unsubscribes every rule and waits for the message being published to each side.
+//Messages still queued are dropped. The clients stay connected.
+func (br *MqttBridge) Close() error {
+	var firstErr error
+	for _, sub := range br.subs {
+		if err := sub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	br.subs = nil
+	br.stopOnce.Do(func() { close(br.stop) })
+	br.workers.Wait()
+	return firstErr
+}
+
+func (br *MqttBridge) forward(route *bridgeRoute, msg *mqttTypes.Publish) {
+	topic := msg.Topic.Whole
+	//the mqtt library calls every subscription matching a topic, so overlapping rules would forward a
+	//message once each. Only the first matching rule from the same side forwards it.
+	for _, other := range br.routes {
+		if other.src == route.src && TopicMatches(other.filter, topic) {
+			if other != route {
+				return
+			}
+			break
+		}
+	}
+	fwd := &bridgeMessage{
+		topic:   topic,
+		target:  rewritePrefix(topic, route.from, route.to),
+		qos:     msg.Header.QOS,
+		retain:  msg.Header.Retain,
+		payload: msg.Payload,
+	}
+	if fwd.qos > uint8(route.qos) {
+		fwd.qos = uint8(route.qos)
+	}
+	select {
+	case <-br.stop:
+		br.drop(topic, fmt.Errorf("Bridge closed"))
+	case br.queues[route.dst] <- fwd:
+	default:
+		br.drop(topic, fmt.Errorf("Too many messages waiting to be forwarded to '%s'", fwd.target))
+	}
+}
+
+//publishQueued publishes the messages queued for dst one at a time, until the bridge is closed
+func (br *MqttBridge) publishQueued(dst MqttClient, queue chan *bridgeMessage) {
+	defer br.workers.Done()
+	for {
+		select {
+		case <-br.stop:
+			for {
+				select {
+				case fwd := <-queue:
+					br.drop(fwd.topic, fmt.Errorf("Bridge closed"))
+				default:
+					return
+				}
+			}
+		case fwd := <-queue:
+			ret := dst.Publish(fwd.target, fwd.qos, fwd.retain, fwd.payload)
+			if !ret.WaitTimeout(_BRIDGE_PUBLISH_TIMEOUT) {
+				br.drop(fwd.topic, fmt.Errorf("Timed out forwarding to '%s'", fwd.target))
+				continue
+			}
+			if err := ret.Error(); err != nil {
+				br.drop(fwd.topic, fmt.Errorf("Error forwarding to '%s': %v", fwd.target, err))
+				continue
+			}
+			atomic.AddUint64(&br.forwarded, 1)
+		}
+	}
+}
+
+func (br *MqttBridge) drop(topic string, err error) {
+	atomic.AddUint64(&br.dropped, 1)
+	if br.OnDrop != nil {
+		br.OnDrop(topic, err)
+	}
+}
+
+//targets returns filters covering the topics the route publishes to
+func (route *bridgeRoute) targets() []string {
+	rewritten := rewritePrefix(route.filter, route.from, route.to)
+	targets := []string{rewritten}
+	//a filter with wildcards where From is, like "+/x" for From "site", matches topics that are rewritten
+	//although the filter itself isn't
+	if rewritten == route.filter && route.from != route.to &&
+		(filtersOverlap(route.filter, route.from) || filtersOverlap(route.filter, route.from+"/#")) {
+		targets = append(targets, joinTopic(route.to, "#"))
+	}
+	return targets
+}
+
+//rewritePrefix replaces the leading levels from in topic with to. Only whole levels match,
+//so from "a/b" rewrites "a/b" and "a/b/c" but not "a/bc".
+func rewritePrefix(topic, from, to string) string {
+	from, to = strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")
+	if from == to {
+		return topic
+	}
+	var rest string
+	switch {
+	case from == "":
+		rest = topic
+	case topic == from:
+		rest = ""
+	case strings.HasPrefix(topic, from+"/"):
+		rest = topic[len(from)+1:]
+	default:
+		return topic
+	}
+	if rest == "" && to == "" {
+		return topic
+	}
+	return joinTopic(to, rest)
+}
+
+func joinTopic(prefix, rest string) string {
+	switch {
+	case prefix == "":
+		return rest
+	case rest == "":
+		return prefix
+	}
+	return prefix + "/" + rest
+}
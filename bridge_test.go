@@ -0,0 +1,53 @@
+package GoSDK
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBridgeRewritePrefix(t *testing.T) {
+	cases := []struct {
+		topic, from, to, want string
+	}{
+		{"site/a/temp", "site", "edge", "edge/a/temp"},
+		{"site", "site", "edge", "edge"},
+		{"site/a", "site/", "edge/", "edge/a"},
+		//only whole levels match
+		{"sites/a", "site", "edge", "sites/a"},
+		{"a/site/b", "site", "edge", "a/site/b"},
+		{"a/b", "", "edge", "edge/a/b"},
+		{"site/a", "site", "", "a"},
+		//removing the whole topic leaves it alone rather than publish to an empty topic
+		{"site", "site", "", "site"},
+		{"x/y", "x/y", "z", "z"},
+		{"x/y/z", "x/y", "z", "z/z"},
+		{"site/a", "site", "site", "site/a"},
+	}
+	for _, c := range cases {
+		if got := rewritePrefix(c.topic, c.from, c.to); got != c.want {
+			t.Errorf("rewritePrefix(%q, %q, %q) = %q, want %q", c.topic, c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestBridgeRouteTargets(t *testing.T) {
+	cases := []struct {
+		filter, from, to string
+		want             []string
+	}{
+		{"site/#", "site", "edge", []string{"edge/#"}},
+		{"site/+/temp", "site", "edge", []string{"edge/+/temp"}},
+		{"other/#", "site", "edge", []string{"other/#"}},
+		{"#", "", "edge", []string{"edge/#"}},
+		//wildcards where From is match topics that are rewritten although the filter isn't
+		{"+/temp", "site", "edge", []string{"+/temp", "edge/#"}},
+		{"#", "site", "edge", []string{"#", "edge/#"}},
+		{"+/temp", "site", "site", []string{"+/temp"}},
+	}
+	for _, c := range cases {
+		route := &bridgeRoute{filter: c.filter, from: c.from, to: c.to}
+		if got := route.targets(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("targets of %q from %q to %q = %v, want %v", c.filter, c.from, c.to, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package GoSDK
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//This file holds a small CBOR (RFC 8949) encoder and decoder for CBORCodec. Encoding works on Go values by
+//reflection, honoring json struct tags. Decoding produces the same generic values encoding/json does, which
+//are then converted to the destination type through encoding/json, so destinations follow json rules.
+
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborFalse      = 0xf4
+	cborTrue       = 0xf5
+	cborNull       = 0xf6
+	cborUndefined  = 0xf7
+	cborFloat16    = 0xf9
+	cborFloat32    = 0xfa
+	cborFloat64    = 0xfb
+	cborBreak      = 0xff
+	cborIndefinite = 31
+
+	cborMaxDepth = 512
+)
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	jsonNumberType  = reflect.TypeOf(json.Number(""))
+	cborRawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+func cborMarshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := cborEncode(buf, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborInt(buf *bytes.Buffer, n int64) {
+	if n >= 0 {
+		cborHead(buf, cborUint, uint64(n))
+		return
+	}
+	cborHead(buf, cborNegint, uint64(-(n + 1)))
+}
+
+func cborEncode(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	if depth > cborMaxDepth {
+		return fmt.Errorf("CBOR encoding error: value is nested too deeply")
+	}
+	if !v.IsValid() {
+		buf.WriteByte(cborNull)
+		return nil
+	}
+	switch v.Type() {
+	case timeType:
+		buf.WriteByte(0xc0) //tag 0, date/time string
+		s := v.Interface().(time.Time).Format(time.RFC3339Nano)
+		cborHead(buf, cborText, uint64(len(s)))
+		buf.WriteString(s)
+		return nil
+	case jsonNumberType:
+		s := v.String()
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			cborInt(buf, n)
+			return nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("CBOR encoding error: invalid number %q", s)
+		}
+		buf.WriteByte(cborFloat64)
+		binary.Write(buf, binary.BigEndian, f)
+		return nil
+	case cborRawJSONType:
+		var generic interface{}
+		if err := json.Unmarshal(v.Bytes(), &generic); err != nil {
+			return fmt.Errorf("CBOR encoding error: %v", err)
+		}
+		return cborEncode(buf, reflect.ValueOf(generic), depth+1)
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		return cborEncode(buf, v.Elem(), depth+1)
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cborInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cborHead(buf, cborUint, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(cborFloat32)
+		binary.Write(buf, binary.BigEndian, float32(v.Float()))
+	case reflect.Float64:
+		buf.WriteByte(cborFloat64)
+		binary.Write(buf, binary.BigEndian, v.Float())
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return fmt.Errorf("CBOR encoding error: string is not valid UTF-8")
+		}
+		cborHead(buf, cborText, uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			cborHead(buf, cborBytes, uint64(len(b)))
+			buf.Write(b)
+			return nil
+		}
+		cborHead(buf, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := cborEncode(buf, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+		//keys are sorted by their encoding so the output is deterministic
+		type entry struct {
+			key []byte
+			val reflect.Value
+		}
+		entries := make([]entry, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			kb := &bytes.Buffer{}
+			if err := cborEncode(kb, iter.Key(), depth+1); err != nil {
+				return err
+			}
+			entries = append(entries, entry{kb.Bytes(), iter.Value()})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+		cborHead(buf, cborMap, uint64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e.key)
+			if err := cborEncode(buf, e.val, depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := cborStructFields(v)
+		cborHead(buf, cborMap, uint64(len(fields)))
+		for _, f := range fields {
+			cborHead(buf, cborText, uint64(len(f.name)))
+			buf.WriteString(f.name)
+			if err := cborEncode(buf, f.val, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("CBOR encoding error: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type cborField struct {
+	name string
+	val  reflect.Value
+}
+
+//cborStructFields lists the fields encoding/json would encode, under the same names
+func cborStructFields(v reflect.Value) []cborField {
+	var fields []cborField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+		fv := v.Field(i)
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, cborStructFields(fv)...)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if strings.Contains(opts, "omitempty") && cborIsEmpty(fv) {
+			continue
+		}
+		fields = append(fields, cborField{name, fv})
+	}
+	return fields
+}
+
+func cborIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func cborUnmarshal(data []byte, v interface{}) error {
+	d := &cborDecoder{data: data}
+	generic, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("CBOR decoding error: %d trailing bytes", len(data)-d.pos)
+	}
+	if p, ok := v.(*interface{}); ok {
+		*p = cborNormalize(generic)
+		return nil
+	}
+	if p, ok := v.(*[]byte); ok {
+		if b, isBytes := generic.([]byte); isBytes {
+			*p = b
+			return nil
+		}
+	}
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return fmt.Errorf("CBOR decoding error: %v", err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+//cborNormalize turns integers into float64, like encoding/json does when decoding into an interface{}
+func cborNormalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case []interface{}:
+		for i := range val {
+			val[i] = cborNormalize(val[i])
+		}
+	case map[string]interface{}:
+		for k := range val {
+			val[k] = cborNormalize(val[k])
+		}
+	}
+	return v
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+//remaining is the number of bytes not yet decoded
+func (d *cborDecoder) remaining() uint64 {
+	return uint64(len(d.data) - d.pos)
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("CBOR decoding error: unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+//head reads an item's initial byte and argument. indefinite is set for the indefinite length marker.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		b, err = d.next(1)
+		if err == nil {
+			arg = uint64(b[0])
+		}
+	case info == 25:
+		b, err = d.next(2)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint16(b))
+		}
+	case info == 26:
+		b, err = d.next(4)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint32(b))
+		}
+	case info == 27:
+		b, err = d.next(8)
+		if err == nil {
+			arg = binary.BigEndian.Uint64(b)
+		}
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap:
+	case info == cborIndefinite && major == cborSimple:
+	default:
+		err = fmt.Errorf("CBOR decoding error: invalid additional information %d", info)
+	}
+	return major, info, arg, err
+}
+
+//bytes returns the next n bytes, checking n against the data left before converting it to an int
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > d.remaining() {
+		return nil, fmt.Errorf("CBOR decoding error: unexpected end of data")
+	}
+	return d.next(int(n))
+}
+
+func (d *cborDecoder) atBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("CBOR decoding error: data is nested too deeply")
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+	case cborNegint:
+		if arg > math.MaxInt64 {
+			n := new(big.Int).SetUint64(arg)
+			return json.Number("-" + n.Add(n, big.NewInt(1)).String()), nil
+		}
+		return json.Number(strconv.FormatInt(-1-int64(arg), 10)), nil
+	case cborBytes, cborText:
+		var b []byte
+		if info == cborIndefinite {
+			//the chunks of an indefinite length string are definite length strings of the same type
+			for !d.atBreak() {
+				chunkMajor, chunkInfo, n, err := d.head()
+				if err != nil {
+					return nil, err
+				}
+				if chunkMajor != major || chunkInfo == cborIndefinite {
+					return nil, fmt.Errorf("CBOR decoding error: invalid chunk in indefinite length string")
+				}
+				chunk, err := d.bytes(n)
+				if err != nil {
+					return nil, err
+				}
+				b = append(b, chunk...)
+			}
+		} else {
+			chunk, err := d.bytes(arg)
+			if err != nil {
+				return nil, err
+			}
+			b = append([]byte{}, chunk...)
+		}
+		if major == cborText {
+			if !utf8.Valid(b) {
+				return nil, fmt.Errorf("CBOR decoding error: text string is not valid UTF-8")
+			}
+			return string(b), nil
+		}
+		if b == nil {
+			b = []byte{}
+		}
+		return b, nil
+	case cborArray:
+		//every item takes at least a byte, so a longer length can't be satisfied
+		if info != cborIndefinite && arg > d.remaining() {
+			return nil, fmt.Errorf("CBOR decoding error: unexpected end of data")
+		}
+		arr := []interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.atBreak() {
+				break
+			}
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, nil
+	case cborMap:
+		if info != cborIndefinite && arg > d.remaining()/2 {
+			return nil, fmt.Errorf("CBOR decoding error: unexpected end of data")
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.atBreak() {
+				break
+			}
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			val, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k := key.(type) {
+			case string:
+				m[k] = val
+			case json.Number:
+				m[k.String()] = val
+			case float64:
+				m[strconv.FormatFloat(k, 'f', -1, 64)] = val
+			default:
+				m[fmt.Sprint(k)] = val
+			}
+		}
+		return m, nil
+	case cborTag:
+		//tags only annotate the item that follows, which is returned as is
+		return d.decode(depth + 1)
+	default:
+		switch info {
+		case cborFalse & 0x1f:
+			return false, nil
+		case cborTrue & 0x1f:
+			return true, nil
+		case cborNull & 0x1f, cborUndefined & 0x1f:
+			return nil, nil
+		case cborFloat16 & 0x1f:
+			return cborHalfToFloat(uint16(arg)), nil
+		case cborFloat32 & 0x1f:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case cborFloat64 & 0x1f:
+			return math.Float64frombits(arg), nil
+		case cborIndefinite:
+			return nil, fmt.Errorf("CBOR decoding error: unexpected break")
+		default:
+			return nil, fmt.Errorf("CBOR decoding error: unsupported simple value %d", arg)
+		}
+	}
+}
+
+func cborHalfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
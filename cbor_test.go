@@ -0,0 +1,241 @@
+package GoSDK
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cborTestInner struct {
+	ID    int    `json:"id"`
+	Label string `json:"label,omitempty"`
+}
+
+type cborTestRecord struct {
+	Name    string                 `json:"name"`
+	Count   int                    `json:"count"`
+	Big     uint64                 `json:"big"`
+	Neg     int64                  `json:"neg"`
+	Ratio   float64                `json:"ratio"`
+	Small   float32                `json:"small"`
+	On      bool                   `json:"on"`
+	Tags    []string               `json:"tags"`
+	Raw     []byte                 `json:"raw"`
+	Inner   *cborTestInner         `json:"inner"`
+	Missing *cborTestInner         `json:"missing"`
+	Extra   map[string]interface{} `json:"extra"`
+	When    time.Time              `json:"when"`
+	Skipped string                 `json:"-"`
+	Empty   string                 `json:"empty,omitempty"`
+}
+
+func TestCBORRoundTripStruct(t *testing.T) {
+	in := &cborTestRecord{
+		Name:  "sensor/1 ü",
+		Count: 42,
+		Big:   math.MaxUint64,
+		Neg:   math.MinInt64,
+		Ratio: 0.125,
+		Small: 1.5,
+		On:    true,
+		Tags:  []string{"a", "", "c"},
+		Raw:   []byte{0, 1, 2, 0xff},
+		Inner: &cborTestInner{ID: 7, Label: "seven"},
+		Extra: map[string]interface{}{"x": 1.5, "y": "z", "list": []interface{}{true, nil}},
+		When:  time.Date(2020, 2, 29, 13, 14, 15, 123456789, time.UTC),
+	}
+	b, err := cborMarshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	out := &cborTestRecord{}
+	if err := cborUnmarshal(b, out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !out.When.Equal(in.When) {
+		t.Errorf("When: got %v, want %v", out.When, in.When)
+	}
+	out.When = in.When
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", out, in)
+	}
+}
+
+func TestCBORRoundTripIntegers(t *testing.T) {
+	ints := []int64{0, 1, 23, 24, 255, 256, 65535, 65536, 1<<32 - 1, 1 << 32, math.MaxInt64,
+		-1, -24, -25, -256, -257, -65537, math.MinInt64}
+	for _, n := range ints {
+		b, err := cborMarshal(n)
+		if err != nil {
+			t.Fatalf("Marshal(%d): %v", n, err)
+		}
+		var got int64
+		if err := cborUnmarshal(b, &got); err != nil {
+			t.Fatalf("Unmarshal(%d): %v", n, err)
+		}
+		if got != n {
+			t.Errorf("got %d, want %d", got, n)
+		}
+	}
+}
+
+func TestCBORRoundTripGeneric(t *testing.T) {
+	in := map[string]interface{}{
+		"n":     3.0,
+		"s":     "text",
+		"b":     false,
+		"null":  nil,
+		"list":  []interface{}{1.0, "two", []interface{}{}},
+		"inner": map[string]interface{}{"k": -2.5},
+	}
+	b, err := cborMarshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out interface{}
+	if err := cborUnmarshal(b, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(out, interface{}(in)) {
+		t.Errorf("got %#v, want %#v", out, in)
+	}
+}
+
+func TestCBORMarshalIsDeterministic(t *testing.T) {
+	v := map[string]int{"b": 2, "a": 1, "c": 3, "aa": 4}
+	first, err := cborMarshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		again, _ := cborMarshal(v)
+		if !bytes.Equal(first, again) {
+			t.Fatalf("encodings differ: %x and %x", first, again)
+		}
+	}
+}
+
+func TestCBORMarshalRejectsInvalidUTF8(t *testing.T) {
+	if _, err := cborMarshal("\xc3\x28"); err == nil {
+		t.Error("expected an error for invalid UTF-8")
+	}
+}
+
+//examples from RFC 8949 appendix A
+func TestCBORDecodeRFCExamples(t *testing.T) {
+	cases := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", 0.0},
+		{"1903e8", 1000.0},
+		{"3903e7", -1000.0},
+		{"f93c00", 1.0},
+		{"f9c400", -4.0},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"f4", false},
+		{"f6", nil},
+		{"f7", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"83010203", []interface{}{1.0, 2.0, 3.0}},
+		{"a201020304", map[string]interface{}{"1": 2.0, "3": 4.0}},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []interface{}{1.0, []interface{}{2.0, 3.0}, []interface{}{4.0, 5.0}}},
+		{"bf61610161629f0203ffff", map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}}},
+	}
+	for _, c := range cases {
+		data, _ := hex.DecodeString(c.hex)
+		var got interface{}
+		if err := cborUnmarshal(data, &got); err != nil {
+			t.Errorf("%s: %v", c.hex, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.hex, got, c.want)
+		}
+	}
+	var inf interface{}
+	if err := cborUnmarshal([]byte{0xf9, 0x7c, 0x00}, &inf); err != nil || !math.IsInf(inf.(float64), 1) {
+		t.Errorf("f97c00: got %v, %v", inf, err)
+	}
+}
+
+func TestCBORDecodeMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		hex  string
+	}{
+		{"empty", ""},
+		{"missing argument", "18"},
+		{"truncated argument", "1b0000"},
+		{"reserved additional information", "1c"},
+		{"huge byte string", "5bffffffffffffffff"},
+		{"byte string longer than the data", "5a7fffffff0102"},
+		{"huge text string", "7bffffffffffffffff41"},
+		{"huge array", "9bffffffffffffffff"},
+		{"array longer than the data", "9a7fffffff00"},
+		{"huge map", "bbffffffffffffffff"},
+		{"map longer than the data", "ba7fffffff0001"},
+		{"map missing a value", "a101"},
+		{"indefinite map missing a value", "bf01ff"},
+		{"array chunk in indefinite byte string", "5f9fffff"},
+		{"nested indefinite chunk", "5f5fffff"},
+		{"text chunk in byte string", "5f6161ff"},
+		{"unterminated indefinite string", "5f4101"},
+		{"unterminated indefinite array", "9f01"},
+		{"invalid UTF-8", "62c328"},
+		{"lone break", "ff"},
+		{"unsupported simple value", "f820"},
+		{"trailing bytes", "0102"},
+		{"tag without content", "c0"},
+		{"nested too deeply", strings.Repeat("81", cborMaxDepth+10) + "00"},
+		{"tags nested too deeply", strings.Repeat("c0", cborMaxDepth+10) + "00"},
+	}
+	for _, c := range cases {
+		data, err := hex.DecodeString(c.hex)
+		if err != nil {
+			t.Fatalf("%s: bad test data: %v", c.name, err)
+		}
+		var v interface{}
+		if err := cborUnmarshal(data, &v); err == nil {
+			t.Errorf("%s: expected an error, got %#v", c.name, v)
+		}
+	}
+}
+
+//every truncation of a valid encoding is an error, never a panic
+func TestCBORDecodeTruncated(t *testing.T) {
+	b, err := cborMarshal(&cborTestRecord{
+		Name:  "truncated",
+		Tags:  []string{"x", "y"},
+		Raw:   bytes.Repeat([]byte{9}, 300),
+		Inner: &cborTestInner{ID: 70000},
+		Extra: map[string]interface{}{"deep": []interface{}{map[string]interface{}{"k": 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(b); i++ {
+		var v interface{}
+		if err := cborUnmarshal(b[:i], &v); err == nil {
+			t.Errorf("truncated at %d of %d: expected an error", i, len(b))
+		}
+	}
+}
+
+func TestTypedClientRequiresDecodeErrorHandler(t *testing.T) {
+	tc := NewTypedClient(nil, NewCodecs(CBORCodec{}))
+	_, err := tc.Subscribe("t", 0, func() interface{} { return &cborTestInner{} }, func(string, interface{}) {})
+	if err == nil {
+		t.Error("expected Subscribe to require OnDecodeError")
+	}
+}
@@ -0,0 +1,441 @@
+package GoSDK
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	_DEFAULT_CHUNK_SIZE          = 128 * 1024
+	_DEFAULT_CHUNK_TIMEOUT       = 30 * time.Second
+	_DEFAULT_CHUNK_MAX_SIZE      = 64 * 1024 * 1024
+	_CHUNK_MAGIC                 = "CBCK"
+	_CHUNK_ID_LEN                = 20
+	_CHUNK_HEADER_LEN            = len(_CHUNK_MAGIC) + 1 + _CHUNK_ID_LEN + 4
+	_CHUNK_KIND_MANIFEST    byte = 0
+	_CHUNK_KIND_DATA        byte = 1
+)
+
+var (
+	//ErrTransferTooLarge is reported when a manifest announces more bytes than ChunkReceiverOptions.MaxSize
+	ErrTransferTooLarge = errors.New("Chunked transfer exceeds the maximum size")
+	//ErrChecksumMismatch is reported when a reassembled payload does not match its manifest's checksum
+	ErrChecksumMismatch = errors.New("Chunked transfer checksum mismatch")
+)
+
+//TransferManifest describes a chunked payload. It is published ahead of the chunks.
+type TransferManifest struct {
+	ID        string `json:"id"`
+	Size      int    `json:"size"`
+	Chunks    int    `json:"chunks"`
+	ChunkSize int    `json:"chunk_size"`
+	//SHA256 is the hex checksum of the whole payload
+	SHA256 string `json:"sha256"`
+}
+
+//TransferProgress reports how far a chunked transfer has got
+type TransferProgress struct {
+	ID    string
+	Topic string
+	//Received and Total count chunks. Total is zero until the manifest has arrived.
+	Received int
+	Total    int
+	Bytes    int
+}
+
+//TransferError is reported for a transfer that was abandoned
+type TransferError struct {
+	ID    string
+	Topic string
+	//Missing holds the sequence numbers of the chunks that never arrived, when the manifest did
+	Missing []int
+	Err     error
+}
+
+func (e *TransferError) Error() string {
+	if len(e.Missing) > 0 {
+		return fmt.Sprintf("Chunked transfer %s on '%s' failed: %v, missing chunks %v", e.ID, e.Topic, e.Err, e.Missing)
+	}
+	return fmt.Sprintf("Chunked transfer %s on '%s' failed: %v", e.ID, e.Topic, e.Err)
+}
+
+//ChunkOptions controls how PublishChunked splits a payload
+type ChunkOptions struct {
+	//ChunkSize is the number of payload bytes per message. Defaults to 128KB.
+	ChunkSize int
+	Qos       int
+	//OnProgress is called after each chunk is published
+	OnProgress func(sent, total int)
+}
+
+//PublishChunked splits payload into chunks small enough for the broker and publishes them to topic,
+//preceded by a manifest. It returns the transfer id. Receive them with NewChunkReceiver.
+func PublishChunked(c MqttClient, topic string, payload []byte, opts ChunkOptions) (string, error) {
+	if c == nil {
+		return "", errors.New("MQTTClient is uninitialized")
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = _DEFAULT_CHUNK_SIZE
+	}
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	manifest := &TransferManifest{
+		ID:        id,
+		Size:      len(payload),
+		Chunks:    chunkCount(len(payload), opts.ChunkSize),
+		ChunkSize: opts.ChunkSize,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	if err := publishChunk(c, topic, opts.Qos, chunkFrame(_CHUNK_KIND_MANIFEST, manifest.ID, 0, body)); err != nil {
+		return "", fmt.Errorf("Error publishing manifest: %v", err)
+	}
+	for seq := 0; seq < manifest.Chunks; seq++ {
+		start := seq * opts.ChunkSize
+		end := start + opts.ChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if err := publishChunk(c, topic, opts.Qos, chunkFrame(_CHUNK_KIND_DATA, manifest.ID, seq, payload[start:end])); err != nil {
+			return manifest.ID, fmt.Errorf("Error publishing chunk %d of %d: %v", seq, manifest.Chunks, err)
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(seq+1, manifest.Chunks)
+		}
+	}
+	return manifest.ID, nil
+}
+
+//chunkCount is the number of chunks a payload is split into. An empty payload still takes one, empty, chunk.
+func chunkCount(size, chunkSize int) int {
+	if size == 0 {
+		return 1
+	}
+	return (size + chunkSize - 1) / chunkSize
+}
+
+//validate checks that a received manifest describes a payload that can be reassembled within maxSize
+func (m *TransferManifest) validate(maxSize int) error {
+	if m.Size < 0 || m.ChunkSize <= 0 || m.Chunks <= 0 {
+		return fmt.Errorf("Bad manifest: size %d, %d chunks of %d bytes", m.Size, m.Chunks, m.ChunkSize)
+	}
+	if m.Size > maxSize {
+		return ErrTransferTooLarge
+	}
+	if m.Chunks != chunkCount(m.Size, m.ChunkSize) {
+		return fmt.Errorf("Bad manifest: %d chunks of %d bytes can't hold %d bytes", m.Chunks, m.ChunkSize, m.Size)
+	}
+	return nil
+}
+
+//publishChunk waits for each chunk, so a large transfer doesn't pile up in the client's outgoing queue
+func publishChunk(c MqttClient, topic string, qos int, frame []byte) error {
+	ret := c.Publish(topic, uint8(qos), false, frame)
+	ret.Wait()
+	return ret.Error()
+}
+
+//chunkFrame prefixes data with the magic, the kind, the transfer id and the sequence number
+func chunkFrame(kind byte, id string, seq int, data []byte) []byte {
+	frame := make([]byte, _CHUNK_HEADER_LEN, _CHUNK_HEADER_LEN+len(data))
+	copy(frame, _CHUNK_MAGIC)
+	frame[len(_CHUNK_MAGIC)] = kind
+	copy(frame[len(_CHUNK_MAGIC)+1:], id)
+	binary.BigEndian.PutUint32(frame[_CHUNK_HEADER_LEN-4:], uint32(seq))
+	return append(frame, data...)
+}
+
+func parseChunkFrame(payload []byte) (kind byte, id string, seq int, data []byte, ok bool) {
+	if len(payload) < _CHUNK_HEADER_LEN || !bytes.HasPrefix(payload, []byte(_CHUNK_MAGIC)) {
+		return 0, "", 0, nil, false
+	}
+	kind = payload[len(_CHUNK_MAGIC)]
+	if kind != _CHUNK_KIND_MANIFEST && kind != _CHUNK_KIND_DATA {
+		return 0, "", 0, nil, false
+	}
+	id = string(payload[len(_CHUNK_MAGIC)+1 : _CHUNK_HEADER_LEN-4])
+	seq = int(binary.BigEndian.Uint32(payload[_CHUNK_HEADER_LEN-4 : _CHUNK_HEADER_LEN]))
+	return kind, id, seq, payload[_CHUNK_HEADER_LEN:], true
+}
+
+//ChunkedMessage is a reassembled payload. Manifest is nil for messages that were not chunked.
+type ChunkedMessage struct {
+	Topic    string
+	Payload  []byte
+	Manifest *TransferManifest
+}
+
+//ChunkReceiverOptions controls reassembly
+type ChunkReceiverOptions struct {
+	Qos int
+	//Timeout abandons a transfer when no chunk has arrived for this long. Defaults to 30 seconds.
+	Timeout time.Duration
+	//MaxSize rejects manifests announcing larger payloads, and transfers buffering more. Defaults to 64MB.
+	MaxSize int
+	//OnProgress is called after each chunk is stored
+	OnProgress func(TransferProgress)
+	//OnError is called with a *TransferError when a transfer times out, is too large or fails its checksum
+	OnError func(error)
+	//Options applies to the underlying subscription
+	Options SubscribeOptions
+}
+
+//ChunkReceiver reassembles chunked transfers published to a topic filter
+type ChunkReceiver struct {
+	sub       *Subscription
+	opts      ChunkReceiverOptions
+	handler   func(*ChunkedMessage)
+	lock      sync.Mutex
+	transfers map[string]*chunkTransfer
+	//finished remembers the ids of completed and failed transfers until the time they map to,
+	//so chunks redelivered after the end of a transfer don't start it again
+	finished map[string]time.Time
+	closed   bool
+}
+
+type chunkTransfer struct {
+	topic    string
+	manifest *TransferManifest
+	chunks   map[int][]byte
+	bytes    int
+	timer    *time.Timer
+}
+
+//NewChunkReceiver subscribes to filter and passes each reassembled payload to handler.
+//Messages on filter that were not chunked are passed through as they are.
+func NewChunkReceiver(c MqttClient, filter string, opts ChunkReceiverOptions, handler func(*ChunkedMessage)) (*ChunkReceiver, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Handler is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = _DEFAULT_CHUNK_TIMEOUT
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = _DEFAULT_CHUNK_MAX_SIZE
+	}
+	r := &ChunkReceiver{
+		opts:      opts,
+		handler:   handler,
+		transfers: map[string]*chunkTransfer{},
+		finished:  map[string]time.Time{},
+	}
+	sub, err := subscribeWithOptions(c, filter, opts.Qos, opts.Options, r.receive)
+	if err != nil {
+		return nil, err
+	}
+	r.sub = sub
+	return r, nil
+}
+
+//Pending returns the progress of the transfers still being reassembled
+func (r *ChunkReceiver) Pending() []TransferProgress {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rval := make([]TransferProgress, 0, len(r.transfers))
+	for id, t := range r.transfers {
+		rval = append(rval, t.progress(id))
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+//Close unsubscribes and drops the incomplete transfers
+func (r *ChunkReceiver) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	for _, t := range r.transfers {
+		t.timer.Stop()
+	}
+	r.transfers = map[string]*chunkTransfer{}
+	r.lock.Unlock()
+	return r.sub.Unsubscribe()
+}
+
+func (r *ChunkReceiver) receive(msg *mqttTypes.Publish) {
+	kind, id, seq, data, ok := parseChunkFrame(msg.Payload)
+	if !ok {
+		r.handler(&ChunkedMessage{Topic: msg.Topic.Whole, Payload: msg.Payload})
+		return
+	}
+	done, progress, err := r.store(msg.Topic.Whole, kind, id, seq, data)
+	if progress != nil && r.opts.OnProgress != nil {
+		r.opts.OnProgress(*progress)
+	}
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	if done != nil {
+		r.handler(done)
+	}
+}
+
+//store adds a manifest or a chunk to its transfer and returns the payload once it is complete
+func (r *ChunkReceiver) store(topic string, kind byte, id string, seq int, data []byte) (*ChunkedMessage, *TransferProgress, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, nil, nil
+	}
+	if until, ok := r.finished[id]; ok && time.Now().Before(until) {
+		return nil, nil, nil
+	}
+	t, ok := r.transfers[id]
+	if !ok {
+		//chunks can overtake their manifest, so a transfer starts with whichever arrives first
+		t = &chunkTransfer{topic: topic, chunks: map[int][]byte{}}
+		t.timer = time.AfterFunc(r.opts.Timeout, func() { r.expire(id) })
+		r.transfers[id] = t
+	} else {
+		t.timer.Reset(r.opts.Timeout)
+	}
+	switch kind {
+	case _CHUNK_KIND_MANIFEST:
+		manifest := &TransferManifest{}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			r.finish(id)
+			return nil, nil, &TransferError{ID: id, Topic: topic, Err: fmt.Errorf("Bad manifest: %v", err)}
+		}
+		if err := manifest.validate(r.opts.MaxSize); err != nil {
+			r.finish(id)
+			return nil, nil, &TransferError{ID: id, Topic: topic, Err: err}
+		}
+		t.manifest = manifest
+		//chunks that overtook the manifest are checked now
+		for seq, data := range t.chunks {
+			if err := t.check(seq, data); err != nil {
+				r.finish(id)
+				return nil, nil, &TransferError{ID: id, Topic: topic, Err: err}
+			}
+		}
+	case _CHUNK_KIND_DATA:
+		if _, dup := t.chunks[seq]; dup {
+			return nil, nil, nil
+		}
+		t.bytes += len(data)
+		t.chunks[seq] = append([]byte{}, data...)
+		if t.bytes > r.opts.MaxSize {
+			r.finish(id)
+			return nil, nil, &TransferError{ID: id, Topic: topic, Err: ErrTransferTooLarge}
+		}
+		if err := t.check(seq, data); err != nil {
+			r.finish(id)
+			return nil, nil, &TransferError{ID: id, Topic: topic, Err: err}
+		}
+	}
+	progress := t.progress(id)
+	if t.manifest == nil || len(t.missing()) > 0 {
+		return nil, &progress, nil
+	}
+	r.finish(id)
+	payload, err := t.assemble()
+	if err != nil {
+		return nil, &progress, &TransferError{ID: id, Topic: topic, Err: err}
+	}
+	return &ChunkedMessage{Topic: topic, Payload: payload, Manifest: t.manifest}, &progress, nil
+}
+
+func (r *ChunkReceiver) expire(id string) {
+	r.lock.Lock()
+	t, ok := r.transfers[id]
+	if !ok {
+		r.lock.Unlock()
+		return
+	}
+	r.finish(id)
+	r.lock.Unlock()
+	r.fail(&TransferError{ID: id, Topic: t.topic, Missing: t.missing(), Err: fmt.Errorf("timed out after %s", r.opts.Timeout)})
+}
+
+//finish forgets a transfer and ignores its id for another Timeout, the caller must hold the lock
+func (r *ChunkReceiver) finish(id string) {
+	if t, ok := r.transfers[id]; ok {
+		t.timer.Stop()
+	}
+	kept := make(map[string]*chunkTransfer, len(r.transfers))
+	for k, t := range r.transfers {
+		if k != id {
+			kept[k] = t
+		}
+	}
+	r.transfers = kept
+	now := time.Now()
+	finished := make(map[string]time.Time, len(r.finished)+1)
+	for k, until := range r.finished {
+		if now.Before(until) {
+			finished[k] = until
+		}
+	}
+	finished[id] = now.Add(r.opts.Timeout)
+	r.finished = finished
+}
+
+func (r *ChunkReceiver) fail(err error) {
+	if r.opts.OnError != nil {
+		r.opts.OnError(err)
+	}
+}
+
+func (t *chunkTransfer) progress(id string) TransferProgress {
+	p := TransferProgress{ID: id, Topic: t.topic, Received: len(t.chunks), Bytes: t.bytes}
+	if t.manifest != nil {
+		p.Total = t.manifest.Chunks
+	}
+	return p
+}
+
+//check rejects a chunk the manifest doesn't announce, or that is larger than its chunk size
+func (t *chunkTransfer) check(seq int, data []byte) error {
+	if t.manifest == nil {
+		return nil
+	}
+	if seq >= t.manifest.Chunks {
+		return fmt.Errorf("Chunk %d of a transfer of %d chunks", seq, t.manifest.Chunks)
+	}
+	if len(data) > t.manifest.ChunkSize {
+		return fmt.Errorf("Chunk %d holds %d bytes, more than the chunk size of %d", seq, len(data), t.manifest.ChunkSize)
+	}
+	return nil
+}
+
+//missing lists the chunks the manifest announced that have not arrived
+func (t *chunkTransfer) missing() []int {
+	if t.manifest == nil {
+		return nil
+	}
+	var rval []int
+	for seq := 0; seq < t.manifest.Chunks; seq++ {
+		if _, ok := t.chunks[seq]; !ok {
+			rval = append(rval, seq)
+		}
+	}
+	return rval
+}
+
+func (t *chunkTransfer) assemble() ([]byte, error) {
+	payload := make([]byte, 0, t.manifest.Size)
+	for seq := 0; seq < t.manifest.Chunks; seq++ {
+		payload = append(payload, t.chunks[seq]...)
+	}
+	sum := sha256.Sum256(payload)
+	if len(payload) != t.manifest.Size || hex.EncodeToString(sum[:]) != t.manifest.SHA256 {
+		return nil, ErrChecksumMismatch
+	}
+	return payload, nil
+}
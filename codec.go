@@ -0,0 +1,224 @@
+package GoSDK
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+//Codec turns Go values into message payloads and back
+type Codec interface {
+	//Name identifies the codec in topics, when content types are carried by the topic
+	Name() string
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//ProtoMarshaler is implemented by generated protobuf messages that can encode themselves to the wire format.
+//ProtobufCodec calls it to encode.
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+//ProtoUnmarshaler is implemented by generated protobuf messages that can decode themselves from the wire format
+type ProtoUnmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+//JSONCodec encodes payloads with encoding/json
+type JSONCodec struct {
+	//UseNumber decodes numbers in interface{} values as json.Number
+	UseNumber bool
+}
+
+func (JSONCodec) Name() string        { return "json" }
+func (JSONCodec) ContentType() string { return "application/json" }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+//CBORCodec encodes payloads as CBOR. Structs are encoded as maps keyed by their json field names.
+type CBORCodec struct{}
+
+func (CBORCodec) Name() string        { return "cbor" }
+func (CBORCodec) ContentType() string { return "application/cbor" }
+
+func (CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	return cborMarshal(v)
+}
+
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return cborUnmarshal(data, v)
+}
+
+//ProtobufCodec does no protobuf encoding of its own, the SDK doesn't depend on a protobuf library. It only
+//delegates to the Marshal and Unmarshal methods of the value, so values must be messages generated with
+//those methods (as gogo/protobuf generates), implementing ProtoMarshaler and ProtoUnmarshaler, or raw []byte
+//that is passed through as is. Any other value is an error.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string        { return "protobuf" }
+func (ProtobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case ProtoMarshaler:
+		return m.Marshal()
+	case []byte:
+		return m, nil
+	}
+	return nil, fmt.Errorf("Cannot encode %T as protobuf: it does not implement Marshal() ([]byte, error)", v)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case ProtoUnmarshaler:
+		return m.Unmarshal(data)
+	case *[]byte:
+		*m = append([]byte{}, data...)
+		return nil
+	}
+	return fmt.Errorf("Cannot decode protobuf into %T: it does not implement Unmarshal([]byte) error", v)
+}
+
+//Codecs is a set of codecs looked up by name, with a default for topics that don't name one
+type Codecs struct {
+	lock    sync.RWMutex
+	byName  map[string]Codec
+	Default Codec
+}
+
+//NewCodecs returns a set holding the JSON, CBOR and protobuf codecs, with def as the default. A nil def means JSON.
+func NewCodecs(def Codec) *Codecs {
+	if def == nil {
+		def = JSONCodec{}
+	}
+	c := &Codecs{
+		byName:  map[string]Codec{},
+		Default: def,
+	}
+	c.Register(JSONCodec{})
+	c.Register(CBORCodec{})
+	c.Register(ProtobufCodec{})
+	c.Register(def)
+	return c
+}
+
+//Register adds codec to the set, replacing any codec with the same name
+func (c *Codecs) Register(codec Codec) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.byName[codec.Name()] = codec
+}
+
+//Lookup returns the codec called name
+func (c *Codecs) Lookup(name string) (Codec, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	codec, ok := c.byName[name]
+	return codec, ok
+}
+
+//ForTopic picks the codec named by the last level of topic, as written by CodecTopic, or the default.
+//It also returns the topic with the codec level removed.
+func (c *Codecs) ForTopic(topic string) (Codec, string) {
+	if idx := strings.LastIndex(topic, "/"); idx >= 0 {
+		if codec, ok := c.Lookup(topic[idx+1:]); ok {
+			return codec, topic[:idx]
+		}
+	}
+	return c.Default, topic
+}
+
+//CodecTopic appends the codec's name to topic as its last level, the convention ForTopic reads
+func CodecTopic(topic string, codec Codec) string {
+	return strings.TrimRight(topic, "/") + "/" + codec.Name()
+}
+
+//TypedHandler receives a decoded message. topic has the codec level removed when TagTopics is set.
+type TypedHandler func(topic string, v interface{})
+
+//DecodeErrorHandler receives messages that could not be decoded
+type DecodeErrorHandler func(msg *mqttTypes.Publish, err error)
+
+//TypedClient publishes and subscribes Go values, encoding them with codecs
+type TypedClient struct {
+	client MqttClient
+	codecs *Codecs
+	//TagTopics appends the codec name to published topics, and makes subscriptions pick the codec
+	//from the topic's last level. Without it every payload uses the default codec.
+	TagTopics bool
+	//OnDecodeError is called for messages that fail to decode. Subscribe requires it.
+	OnDecodeError DecodeErrorHandler
+	//Options applies to the subscriptions made by Subscribe
+	Options SubscribeOptions
+}
+
+//NewTypedClient returns a TypedClient for c. A nil codecs uses NewCodecs(nil).
+func NewTypedClient(c MqttClient, codecs *Codecs) *TypedClient {
+	if codecs == nil {
+		codecs = NewCodecs(nil)
+	}
+	return &TypedClient{
+		client: c,
+		codecs: codecs,
+	}
+}
+
+//Publish encodes v with the default codec and publishes it
+func (t *TypedClient) Publish(topic string, v interface{}, qos int) error {
+	return t.PublishWith(topic, t.codecs.Default, v, qos)
+}
+
+//PublishWith encodes v with codec and publishes it
+func (t *TypedClient) PublishWith(topic string, codec Codec, v interface{}, qos int) error {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error encoding %s payload: %v", codec.Name(), err)
+	}
+	if t.TagTopics {
+		topic = CodecTopic(topic, codec)
+	}
+	return publish(t.client, topic, payload, qos, 0)
+}
+
+//Subscribe decodes each message on filter into a value made by newValue, usually a pointer to a fresh struct,
+//and passes it to handler. Messages that fail to decode go to OnDecodeError, which must be set.
+func (t *TypedClient) Subscribe(filter string, qos int, newValue func() interface{}, handler TypedHandler) (*Subscription, error) {
+	if newValue == nil || handler == nil {
+		return nil, fmt.Errorf("newValue and handler are required")
+	}
+	if t.OnDecodeError == nil {
+		return nil, fmt.Errorf("OnDecodeError is required")
+	}
+	onError := t.OnDecodeError
+	if t.TagTopics && !strings.HasSuffix(filter, "#") {
+		filter = strings.TrimRight(filter, "/") + "/+"
+	}
+	return subscribeWithOptions(t.client, filter, qos, t.Options, func(msg *mqttTypes.Publish) {
+		codec, topic := t.codecs.Default, msg.Topic.Whole
+		if t.TagTopics {
+			codec, topic = t.codecs.ForTopic(topic)
+		}
+		v := newValue()
+		if err := codec.Unmarshal(msg.Payload, v); err != nil {
+			onError(msg, fmt.Errorf("Error decoding %s payload on '%s': %v", codec.Name(), msg.Topic.Whole, err))
+			return
+		}
+		handler(topic, v)
+	})
+}
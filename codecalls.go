@@ -72,11 +72,15 @@ func getService(c cbClient, systemKey, name string) (*Service, error) {
 	for i, param := range paramsSlice {
 		params[i] = param.(string)
 	}
+	version, err := toInt64(mapBody["current_version"])
+	if err != nil {
+		return nil, fmt.Errorf("Error getting service: %v", err)
+	}
 	svc := &Service{
 		Name:    name,
 		System:  systemKey,
 		Code:    mapBody["code"].(string),
-		Version: int(mapBody["current_version"].(float64)),
+		Version: int(version),
 		Params:  params,
 	}
 	return svc, nil
@@ -1,7 +1,9 @@
 package GoSDK
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync"
 )
 
 //This file provides the interface for establishing connect collections
@@ -10,10 +12,48 @@ import (
 //needs to be trucked across the line during setup. enough that it's more helpful to have it in a
 //struct than it is just in a map, or an endless list of function arguments.
 
-type connectCollection interface {
-	toMap() map[string]interface{}
-	tableName() string
-	name() string
+//ConnectCollection is implemented by the configuration of every connect collection backend
+type ConnectCollection interface {
+	ToMap() map[string]interface{}
+	TableName() string
+	CollectionName() string
+}
+
+//ConnectCollectionDecoder builds a ConnectCollection from the map produced by its ToMap
+type ConnectCollectionDecoder func(map[string]interface{}) (ConnectCollection, error)
+
+var (
+	connectTypesLock sync.RWMutex
+	connectTypes     = map[string]ConnectCollectionDecoder{}
+)
+
+func init() {
+	RegisterConnectCollectionType("mysql", func(co map[string]interface{}) (ConnectCollection, error) {
+		cfg := &MySqlConfig{}
+		return cfg, decodeConnectFields(co, &cfg.Name, &cfg.User, &cfg.Password, &cfg.Host, &cfg.Port, &cfg.DBName, &cfg.Tablename)
+	})
+	RegisterConnectCollectionType("mssql", func(co map[string]interface{}) (ConnectCollection, error) {
+		cfg := &MSSqlConfig{}
+		return cfg, decodeConnectFields(co, &cfg.Name, &cfg.User, &cfg.Password, &cfg.Host, &cfg.Port, &cfg.DBName, &cfg.Tablename)
+	})
+	postgres := func(co map[string]interface{}) (ConnectCollection, error) {
+		cfg := &PostgresqlConfig{}
+		return cfg, decodeConnectFields(co, &cfg.Name, &cfg.User, &cfg.Password, &cfg.Host, &cfg.Port, &cfg.DBName, &cfg.Tablename)
+	}
+	RegisterConnectCollectionType("postgres", postgres)
+	RegisterConnectCollectionType("postgresql", postgres)
+	RegisterConnectCollectionType("MongoDB", func(co map[string]interface{}) (ConnectCollection, error) {
+		cfg := &MongoDBConfig{}
+		return cfg, decodeConnectFields(co, &cfg.Name, &cfg.User, &cfg.Password, &cfg.Host, &cfg.Port, &cfg.DBName, &cfg.Tablename)
+	})
+}
+
+//RegisterConnectCollectionType makes GenerateConnectCollection aware of a connect collection backend.
+//dbtype is the value of the "dbtype" key that the backend's ToMap writes. Registering an existing dbtype replaces it.
+func RegisterConnectCollectionType(dbtype string, decoder ConnectCollectionDecoder) {
+	connectTypesLock.Lock()
+	defer connectTypesLock.Unlock()
+	connectTypes[dbtype] = decoder
 }
 
 //MySqlConfig houses configuration information for an MySql-backed collection
@@ -21,20 +61,11 @@ type MySqlConfig struct {
 	Name, User, Password, Host, Port, DBName, Tablename string
 }
 
-func (my MySqlConfig) tableName() string { return my.Tablename }
-func (my MySqlConfig) name() string      { return my.Name }
+func (my MySqlConfig) TableName() string      { return my.Tablename }
+func (my MySqlConfig) CollectionName() string { return my.Name }
 
-func (my MySqlConfig) toMap() map[string]interface{} {
-	m := make(map[string]interface{})
-	m["name"] = my.Name
-	m["user"] = my.User
-	m["password"] = my.Password
-	m["address"] = my.Host
-	m["port"] = my.Port
-	m["dbname"] = my.DBName
-	m["tablename"] = my.Tablename
-	m["dbtype"] = "mysql"
-	return m
+func (my MySqlConfig) ToMap() map[string]interface{} {
+	return connectFieldsToMap("mysql", my.Name, my.User, my.Password, my.Host, my.Port, my.DBName, my.Tablename)
 }
 
 //MSSqlConfig houses configuration information for an MSSql-backed collection
@@ -42,20 +73,11 @@ type MSSqlConfig struct {
 	Name, User, Password, Host, Port, DBName, Tablename string
 }
 
-func (ms MSSqlConfig) tableName() string { return ms.Tablename }
-func (ms MSSqlConfig) name() string      { return ms.Tablename }
+func (ms MSSqlConfig) TableName() string      { return ms.Tablename }
+func (ms MSSqlConfig) CollectionName() string { return ms.Name }
 
-func (ms MSSqlConfig) toMap() map[string]interface{} {
-	m := make(map[string]interface{})
-	m["user"] = ms.User
-	m["password"] = ms.Password
-	m["address"] = ms.Host
-	m["port"] = ms.Port
-	m["dbname"] = ms.DBName
-	m["tablename"] = ms.Tablename
-	m["dbtype"] = "mssql"
-	m["name"] = ms.Name
-	return m
+func (ms MSSqlConfig) ToMap() map[string]interface{} {
+	return connectFieldsToMap("mssql", ms.Name, ms.User, ms.Password, ms.Host, ms.Port, ms.DBName, ms.Tablename)
 }
 
 //PostgresqlConfig houses configuration information for an Postgresql-backed collection
@@ -63,89 +85,85 @@ type PostgresqlConfig struct {
 	Name, User, Password, Host, Port, DBName, Tablename string
 }
 
-func (pg PostgresqlConfig) toMap() map[string]interface{} {
-	m := make(map[string]interface{})
-	m["user"] = pg.User
-	m["password"] = pg.Password
-	m["address"] = pg.Host
-	m["port"] = pg.Port
-	m["dbname"] = pg.DBName
-	m["tablename"] = pg.Tablename
-	m["dbtype"] = "postgres"
-	m["name"] = pg.Name
-	return m
+func (pg PostgresqlConfig) ToMap() map[string]interface{} {
+	return connectFieldsToMap("postgres", pg.Name, pg.User, pg.Password, pg.Host, pg.Port, pg.DBName, pg.Tablename)
 }
 
-func (pg PostgresqlConfig) tableName() string { return pg.Tablename }
-func (pg PostgresqlConfig) name() string      { return pg.Tablename }
+func (pg PostgresqlConfig) TableName() string      { return pg.Tablename }
+func (pg PostgresqlConfig) CollectionName() string { return pg.Name }
 
 type MongoDBConfig struct {
 	Name, User, Password, Host, Port, DBName, Tablename string
 }
 
-func (mg MongoDBConfig) toMap() map[string]interface{} {
+func (mg MongoDBConfig) ToMap() map[string]interface{} {
+	return connectFieldsToMap("MongoDB", mg.Name, mg.User, mg.Password, mg.Host, mg.Port, mg.DBName, mg.Tablename)
+}
+
+func (mg MongoDBConfig) TableName() string      { return mg.Tablename }
+func (mg MongoDBConfig) CollectionName() string { return mg.Name }
+
+//connectFieldKeys are the map keys of the fields shared by the built in backends, in the order
+//connectFieldsToMap and decodeConnectFields take them
+var connectFieldKeys = []string{"name", "user", "password", "address", "port", "dbname", "tablename"}
+
+func connectFieldsToMap(dbtype string, fields ...string) map[string]interface{} {
 	m := make(map[string]interface{})
-	m["user"] = mg.User
-	m["password"] = mg.Password
-	m["address"] = mg.Host
-	m["port"] = mg.Port
-	m["dbname"] = mg.DBName
-	m["tablename"] = mg.Tablename
-	m["dbtype"] = "MongoDB"
-	m["name"] = mg.Name
+	for i, key := range connectFieldKeys {
+		m[key] = fields[i]
+	}
+	m["dbtype"] = dbtype
 	return m
 }
 
-func (mg MongoDBConfig) tableName() string { return mg.Tablename }
-func (mg MongoDBConfig) name() string      { return mg.Tablename }
+//connectSecretKeys are left out of the maps the platform returns, so they are optional when decoding
+var connectSecretKeys = map[string]bool{"password": true}
+
+func decodeConnectFields(co map[string]interface{}, fields ...*string) error {
+	for i, key := range connectFieldKeys {
+		if connectSecretKeys[key] && co[key] == nil {
+			*fields[i] = ""
+			continue
+		}
+		val, err := ConnectString(co, key)
+		if err != nil {
+			return err
+		}
+		*fields[i] = val
+	}
+	return nil
+}
+
+//ConnectString reads a string field out of a connect collection map, for use by ConnectCollectionDecoders.
+//Numbers are accepted and formatted, since the platform sometimes hands ports back as numbers.
+func ConnectString(co map[string]interface{}, key string) (string, error) {
+	switch val := co[key].(type) {
+	case string:
+		return val, nil
+	case float64, json.Number:
+		return fmt.Sprint(val), nil
+	case nil:
+		return "", fmt.Errorf("generateConnectCollection: %s field missing", key)
+	default:
+		return "", fmt.Errorf("generateConnectCollection: %s field is %T, expected a string", key, val)
+	}
+}
 
-func GenerateConnectCollection(co map[string]interface{}) (connectCollection, error) {
+//GenerateConnectCollection rebuilds a ConnectCollection from its map form, as produced by ToMap
+func GenerateConnectCollection(co map[string]interface{}) (ConnectCollection, error) {
 	dbtype, ok := co["dbtype"].(string)
 	if !ok {
 		return nil, fmt.Errorf("generateConnectCollection: dbtype field missing or is not a string")
 	}
-	switch dbtype {
-	case "mysql":
-		return &MySqlConfig{
-			User:      co["user"].(string),
-			Password:  co["password"].(string),
-			Host:      co["address"].(string),
-			Port:      co["port"].(string),
-			DBName:    co["dbname"].(string),
-			Tablename: co["tablename"].(string),
-			Name:      co["name"].(string),
-		}, nil
-	case "mssql":
-		return &MSSqlConfig{
-			User:      co["user"].(string),
-			Password:  co["password"].(string),
-			Host:      co["address"].(string),
-			Port:      co["port"].(string),
-			DBName:    co["dbname"].(string),
-			Tablename: co["tablename"].(string),
-			Name:      co["name"].(string),
-		}, nil
-	case "postgresql":
-		return &PostgresqlConfig{
-			User:      co["user"].(string),
-			Password:  co["password"].(string),
-			Host:      co["address"].(string),
-			Port:      co["port"].(string),
-			DBName:    co["dbname"].(string),
-			Tablename: co["tablename"].(string),
-			Name:      co["name"].(string),
-		}, nil
-	case "MongoDB":
-		return &MongoDBConfig{
-			User:      co["user"].(string),
-			Password:  co["password"].(string),
-			Host:      co["address"].(string),
-			Port:      co["port"].(string),
-			DBName:    co["dbname"].(string),
-			Tablename: co["tablename"].(string),
-			Name:      co["name"].(string),
-		}, nil
-	default:
+	connectTypesLock.RLock()
+	decoder, ok := connectTypes[dbtype]
+	connectTypesLock.RUnlock()
+	if !ok {
 		return nil, fmt.Errorf("generateConnectCollection: Unknown connect database type: '%s'\n", dbtype)
 	}
+	cfg, err := decoder(co)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
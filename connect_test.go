@@ -0,0 +1,57 @@
+package GoSDK
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnectCollectionRoundTrip(t *testing.T) {
+	connectTypesLock.RLock()
+	dbtypes := []string{}
+	for dbtype := range connectTypes {
+		dbtypes = append(dbtypes, dbtype)
+	}
+	connectTypesLock.RUnlock()
+	for _, dbtype := range dbtypes {
+		in := connectFieldsToMap(dbtype, "coll", "user", "secret", "db.example.com", "5432", "db", "table")
+		first, err := GenerateConnectCollection(in)
+		if err != nil {
+			t.Fatalf("%s: %v", dbtype, err)
+		}
+		out := first.ToMap()
+		second, err := GenerateConnectCollection(out)
+		if err != nil {
+			t.Fatalf("%s: decoding ToMap output: %v", dbtype, err)
+		}
+		if !reflect.DeepEqual(out, second.ToMap()) {
+			t.Errorf("%s: %v did not round trip, got %v", dbtype, out, second.ToMap())
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("%s: decoded %+v, then %+v", dbtype, first, second)
+		}
+		if second.CollectionName() != "coll" || second.TableName() != "table" {
+			t.Errorf("%s: got collection '%s' and table '%s'", dbtype, second.CollectionName(), second.TableName())
+		}
+	}
+}
+
+func TestConnectCollectionPasswordOptional(t *testing.T) {
+	in := (MySqlConfig{Name: "coll", User: "user", Password: "secret", Host: "h", Port: "3306", DBName: "db", Tablename: "t"}).ToMap()
+	kept := map[string]interface{}{}
+	for k, v := range in {
+		if k != "password" {
+			kept[k] = v
+		}
+	}
+	cfg, err := GenerateConnectCollection(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.(*MySqlConfig).Password != "" {
+		t.Errorf("got password '%s'", cfg.(*MySqlConfig).Password)
+	}
+	kept["user"] = nil
+	if _, err := GenerateConnectCollection(kept); err == nil {
+		t.Error("expected a missing user to be an error")
+	}
+}
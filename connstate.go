@@ -0,0 +1,184 @@
+package GoSDK
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+const _CONNECTION_EVENT_BUFFER = 20
+
+//ConnectionState is the kind of a ConnectionEvent
+type ConnectionState int
+
+const (
+	//StateConnected is sent when the client first connects to the broker
+	StateConnected ConnectionState = iota
+	//StateConnectionLost is sent when the connection drops. The client reconnects on its own.
+	StateConnectionLost
+	//StateReconnected is sent after a reconnect, once every tracked subscription has been restored
+	StateReconnected
+	//StateResubscribeFailed is sent for each subscription that could not be restored after a reconnect
+	StateResubscribeFailed
+	//StateDisconnected is sent when the client is disconnected on purpose. The event channel is closed afterwards.
+	StateDisconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateConnectionLost:
+		return "connection lost"
+	case StateReconnected:
+		return "reconnected"
+	case StateResubscribeFailed:
+		return "resubscribe failed"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+//ConnectionEvent describes a change in the state of an mqtt connection
+type ConnectionEvent struct {
+	State ConnectionState
+	Time  time.Time
+	//Topic is set for StateResubscribeFailed
+	Topic string
+	Err   error
+}
+
+//connectionWatcher tracks the connection state of an mqttBaseClient and fans events out to listeners
+type connectionWatcher struct {
+	lock      sync.Mutex
+	connects  int
+	listeners []chan ConnectionEvent
+	closed    bool
+	//current is the last event that changed the connection state, sent first to new listeners
+	current *ConnectionEvent
+}
+
+//ConnectionEvents returns a channel of connection state changes for the client's mqtt connection.
+//The first event on the channel is the current state, once the client has connected.
+//Events are dropped rather than stalling the connection if the channel is not drained.
+func (u *UserClient) ConnectionEvents() (<-chan ConnectionEvent, error) {
+	return connectionEvents(u.MQTTClient)
+}
+
+//ConnectionEvents returns a channel of connection state changes for the client's mqtt connection.
+//The first event on the channel is the current state, once the client has connected.
+//Events are dropped rather than stalling the connection if the channel is not drained.
+func (d *DeviceClient) ConnectionEvents() (<-chan ConnectionEvent, error) {
+	return connectionEvents(d.MQTTClient)
+}
+
+//ConnectionEvents returns a channel of connection state changes for the client's mqtt connection.
+//The first event on the channel is the current state, once the client has connected.
+//Events are dropped rather than stalling the connection if the channel is not drained.
+func (d *DevClient) ConnectionEvents() (<-chan ConnectionEvent, error) {
+	return connectionEvents(d.MQTTClient)
+}
+
+func connectionEvents(c MqttClient) (<-chan ConnectionEvent, error) {
+	if c == nil {
+		return nil, fmt.Errorf("MQTTClient is uninitialized")
+	}
+	b, ok := c.(*mqttBaseClient)
+	if !ok {
+		return nil, fmt.Errorf("Connection events are only available for clients created with InitializeMQTT")
+	}
+	return b.watcher.listen(), nil
+}
+
+func (w *connectionWatcher) listen() <-chan ConnectionEvent {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ch := make(chan ConnectionEvent, _CONNECTION_EVENT_BUFFER)
+	if w.current != nil {
+		ch <- *w.current
+	}
+	if w.closed {
+		close(ch)
+		return ch
+	}
+	w.listeners = append(w.listeners, ch)
+	return ch
+}
+
+func (w *connectionWatcher) emit(ev ConnectionEvent) {
+	ev.Time = time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	if ev.State != StateResubscribeFailed {
+		w.current = &ev
+	}
+	for _, ch := range w.listeners {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+//connected records a connect and reports whether it was a reconnect
+func (w *connectionWatcher) connected() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.connects++
+	return w.connects > 1
+}
+
+func (w *connectionWatcher) close() {
+	w.emit(ConnectionEvent{State: StateDisconnected})
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, ch := range w.listeners {
+		close(ch)
+	}
+	w.listeners = nil
+}
+
+//watchConnection installs the connect and connection lost handlers that restore subscriptions
+//after a reconnect, chaining to the caller's callbacks if there are any
+func (m *mqttBaseClient) watchConnection(o *mqtt.ClientOptions, callbacks *Callbacks) {
+	o.SetOnConnectHandler(func(c mqtt.Client) {
+		if m.watcher.connected() {
+			m.resubscribe()
+			m.watcher.emit(ConnectionEvent{State: StateReconnected})
+		} else {
+			m.watcher.emit(ConnectionEvent{State: StateConnected})
+		}
+		if callbacks != nil && callbacks.OnConnectCallback != nil {
+			callbacks.OnConnectCallback(c)
+		}
+	})
+	o.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		m.watcher.emit(ConnectionEvent{State: StateConnectionLost, Err: err})
+		if callbacks != nil && callbacks.OnConnectionLostCallback != nil {
+			callbacks.OnConnectionLostCallback(c, err)
+		}
+	})
+}
+
+//resubscribe restores every tracked subscription, with its original qos, on the current session
+func (m *mqttBaseClient) resubscribe() {
+	for _, sub := range m.subs.list() {
+		ret := m.Client.Subscribe(sub.Topic, uint8(sub.Qos), sub.callback)
+		if !ret.WaitTimeout(time.Duration(m.timeout)*time.Second + time.Second) {
+			m.watcher.emit(ConnectionEvent{State: StateResubscribeFailed, Topic: sub.Topic, Err: fmt.Errorf("Timed out resubscribing")})
+		} else if err := ret.Error(); err != nil {
+			m.watcher.emit(ConnectionEvent{State: StateResubscribeFailed, Topic: sub.Topic, Err: err})
+		}
+	}
+}
@@ -149,8 +149,11 @@ func getItemCount(c cbClient, collection_id string) (int, error) {
 		return -1, fmt.Errorf("Error getting count: %v", resp.Body)
 	}
 	bod := resp.Body.(map[string]interface{})
-	theCount := int(bod["count"].(float64))
-	return theCount, nil
+	theCount, err := toFloat64(bod["count"])
+	if err != nil {
+		return -1, fmt.Errorf("Error getting count: %v", err)
+	}
+	return int(theCount), nil
 
 }
 
@@ -363,7 +366,7 @@ func updatedataByName(c cbClient, system_key, collection_name string, query *Que
 	if fmtBody, ok = resp.Body.(map[string]interface{}); !ok {
 		return UpdateResponse{}, fmt.Errorf("Unexpected response type from update. Body is - %+v\n", resp.Body)
 	}
-	if count, ok := fmtBody["count"].(float64); !ok {
+	if count, err := toFloat64(fmtBody["count"]); err != nil {
 		return UpdateResponse{}, fmt.Errorf("No count key in response type from update. Body is - %+v\n", fmtBody)
 	} else {
 		return UpdateResponse{
@@ -0,0 +1,137 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//timestampLayouts are the layouts the platform uses when it serializes timestamp columns
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+//UseJSONNumber controls how response bodies are decoded. When enabled, numbers are
+//decoded as json.Number rather than float64, so large int64 ids and counts keep their precision.
+func (b *client) UseJSONNumber(enabled bool) {
+	b.useNumber = enabled
+}
+
+func (b *client) decodesNumbers() bool {
+	return b.useNumber
+}
+
+//newDecoder wraps dec so that it honors the client's number decoding option
+func newDecoder(c cbClient, dec *json.Decoder) *json.Decoder {
+	if c.decodesNumbers() {
+		dec.UseNumber()
+	}
+	return dec
+}
+
+//toFloat64 converts a decoded JSON number, either float64 or json.Number, into a float64
+func toFloat64(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case json.Number:
+		return n.Float64()
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	default:
+		return 0, fmt.Errorf("Expected a number, got %T", v)
+	}
+}
+
+//toInt64 converts a decoded JSON number, either float64 or json.Number, into an int64
+//without losing precision when the value was decoded as a json.Number
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		return int64(f), err
+	default:
+		f, err := toFloat64(v)
+		return int64(f), err
+	}
+}
+
+//ParseTimestamp converts a platform timestamp value into a time.Time.
+//Strings are parsed as RFC3339 or the postgres timestamp formats. Numbers (float64 or json.Number)
+//are treated as unix seconds, or as unix milliseconds when they are too large to be seconds.
+func ParseTimestamp(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range timestampLayouts {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed, nil
+			}
+		}
+		if n, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return unixToTime(n), nil
+		}
+		return time.Time{}, fmt.Errorf("Unrecognized timestamp format: '%s'", t)
+	case nil:
+		return time.Time{}, fmt.Errorf("Timestamp is null")
+	default:
+		n, err := toInt64(v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Unrecognized timestamp type: %T", v)
+		}
+		return unixToTime(n), nil
+	}
+}
+
+func unixToTime(n int64) time.Time {
+	//anything past the year 5000 in seconds is assumed to be milliseconds
+	if n > 95617584000 || n < -95617584000 {
+		return time.Unix(0, n*int64(time.Millisecond)).UTC()
+	}
+	return time.Unix(n, 0).UTC()
+}
+
+//ParseRowTimestamps replaces the named columns of a single row with time.Time values.
+//Columns that are missing or null are left untouched.
+func ParseRowTimestamps(row map[string]interface{}, columns ...string) error {
+	for _, col := range columns {
+		val, ok := row[col]
+		if !ok || val == nil {
+			continue
+		}
+		t, err := ParseTimestamp(val)
+		if err != nil {
+			return fmt.Errorf("Column '%s': %s", col, err.Error())
+		}
+		row[col] = t
+	}
+	return nil
+}
+
+//ParseTimestampColumns replaces the named columns of every row with time.Time values.
+//rows is typically the "DATA" slice from GetData, the result of GetDevices or GetUsersWithQuery,
+//or the body of a MessageHistory response (use the "time" column there).
+func ParseTimestampColumns(rows []interface{}, columns ...string) error {
+	for i, rowIF := range rows {
+		row, ok := rowIF.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Row %d: expected a map, got %T", i, rowIF)
+		}
+		if err := ParseRowTimestamps(row, columns...); err != nil {
+			return fmt.Errorf("Row %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
@@ -87,12 +87,16 @@ func (d *DevClient) GetSystem(key string) (*System, error) {
 	if !isMap {
 		return nil, fmt.Errorf("Error gathering system information: incorrect return type\n")
 	}
+	tokenTTL, err := toInt64(sysMap["token_ttl"])
+	if err != nil {
+		return nil, fmt.Errorf("Error gathering system information: %v", err)
+	}
 	newSys := &System{
 		Key:         sysMap["appID"].(string),
 		Secret:      sysMap["appSecret"].(string),
 		Name:        sysMap["name"].(string),
 		Description: sysMap["description"].(string),
-		TokenTTL:    int32(sysMap["token_ttl"].(float64)),
+		TokenTTL:    int32(tokenTTL),
 	}
 	return newSys, nil
 
@@ -210,11 +214,11 @@ func (d *DevClient) DevUserInfo() (map[string]interface{}, error) {
 }
 
 //NewConnectCollection creates a new collection that is backed by a datastore of your own choosing.
-func (d *DevClient) NewConnectCollection(systemkey string, connectConfig connectCollection) (string, error) {
+func (d *DevClient) NewConnectCollection(systemkey string, connectConfig ConnectCollection) (string, error) {
 	creds, err := d.credentials()
-	m := connectConfig.toMap()
+	m := connectConfig.ToMap()
 	m["appID"] = systemkey
-	m["name"] = connectConfig.name()
+	m["name"] = connectConfig.CollectionName()
 	if err != nil {
 		return "", err
 	}
@@ -229,12 +233,12 @@ func (d *DevClient) NewConnectCollection(systemkey string, connectConfig connect
 }
 
 //AlterConnectionDetails allows the developer to change or add connection information, such as updating a username
-func (d *DevClient) AlterConnectionDetails(systemkey string, connectConfig connectCollection) error {
+func (d *DevClient) AlterConnectionDetails(systemkey string, connectConfig ConnectCollection) error {
 	creds, err := d.credentials()
 	out := make(map[string]interface{})
-	m := connectConfig.toMap()
+	m := connectConfig.ToMap()
 	out["appID"] = systemkey
-	out["name"] = connectConfig.name()
+	out["name"] = connectConfig.CollectionName()
 	out["connectionStringMap"] = m
 	resp, err := put(d, d.preamble()+"/collectionmanagement", out, creds, nil)
 	if err != nil {
@@ -304,8 +308,12 @@ func (d *DevClient) GetRolesCount(SystemKey string, query *Query) (CountResp, er
 		return CountResp{Count: 0}, fmt.Errorf("Bad type returned by GetRolesCount: %T, %s", resp.Body, resp.Body.(string))
 	}
 
+	count, err := toFloat64(rval["count"])
+	if err != nil {
+		return CountResp{Count: 0}, err
+	}
 	return CountResp{
-		Count: rval["count"].(float64),
+		Count: count,
 	}, nil
 }
 
@@ -80,8 +80,12 @@ func getDevicesCount(client cbClient, systemKey string, preamble string, query *
 		return CountResp{Count: 0}, fmt.Errorf("Bad type returned by getDevicesCount: %T, %s", resp.Body, resp.Body.(string))
 	}
 
+	count, err := toFloat64(rval["count"])
+	if err != nil {
+		return CountResp{Count: 0}, err
+	}
 	return CountResp{
-		Count: rval["count"].(float64),
+		Count: count,
 	}, nil
 }
 
@@ -37,6 +37,9 @@ type EdgeConfig struct {
 	DevMode        bool
 	Stdout         *os.File
 	Stderr         *os.File
+	//Host is the host the edge's listeners are reached at, used by WebSocketAddrs. It isn't passed to the edge.
+	//Empty means localhost, for an edge started by CreateNewEdge.
+	Host string
 }
 
 func CreateNewEdgeWithCmd(e EdgeConfig) (*exec.Cmd, *os.Process, error) {
@@ -379,7 +382,11 @@ func getEdgesCount(client cbClient, systemKey string, preamble string, query *Qu
 		return CountResp{Count: 0}, fmt.Errorf("Bad type returned by getEdgesCount: %T, %s", resp.Body, resp.Body.(string))
 	}
 
+	count, err := toFloat64(rval["count"])
+	if err != nil {
+		return CountResp{Count: 0}, err
+	}
 	return CountResp{
-		Count: rval["count"].(float64),
+		Count: count,
 	}, nil
 }
@@ -0,0 +1,561 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//This file provides typed wrappers around the external database calls. The connection configs
+//and operations build the same maps that AddExternalDBConnection and PerformExternalDBOperation
+//take, but are validated before anything is sent to the platform. The insert, update and delete
+//operations write SQL with positional arguments, values are never written into the statement.
+
+//ExternalDBConfig is implemented by the connection configs of the supported external databases
+type ExternalDBConfig interface {
+	Validate() error
+	DBType() string
+	ToMap() map[string]interface{}
+}
+
+//ExternalDBCredentials are the connection details shared by the supported drivers
+type ExternalDBCredentials struct {
+	User, Password, Host, Port, DBName string
+}
+
+func (c ExternalDBCredentials) validate(dbtype string, requireUser bool) error {
+	if c.Host == "" {
+		return fmt.Errorf("%s external db config: Host is required", dbtype)
+	}
+	if c.Port != "" {
+		if p, err := strconv.Atoi(c.Port); err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("%s external db config: invalid Port '%s'", dbtype, c.Port)
+		}
+	}
+	if c.DBName == "" {
+		return fmt.Errorf("%s external db config: DBName is required", dbtype)
+	}
+	if requireUser && c.User == "" {
+		return fmt.Errorf("%s external db config: User is required", dbtype)
+	}
+	return nil
+}
+
+func (c ExternalDBCredentials) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"user":     c.User,
+		"password": c.Password,
+		"address":  c.Host,
+		"port":     c.Port,
+		"dbname":   c.DBName,
+	}
+}
+
+func externalDBConfigMap(name, dbtype string, creds ExternalDBCredentials) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"dbtype":      dbtype,
+		"credentials": creds.toMap(),
+	}
+}
+
+func validateExternalDBName(dbtype, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s external db config: Name is required", dbtype)
+	}
+	return nil
+}
+
+//PostgresExternalDBConfig houses the connection information for a Postgres external database
+type PostgresExternalDBConfig struct {
+	Name string
+	ExternalDBCredentials
+	SSLMode string
+}
+
+func (pg PostgresExternalDBConfig) DBType() string { return "postgres" }
+
+func (pg PostgresExternalDBConfig) Validate() error {
+	if err := validateExternalDBName(pg.DBType(), pg.Name); err != nil {
+		return err
+	}
+	switch pg.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("postgres external db config: invalid SSLMode '%s'", pg.SSLMode)
+	}
+	return pg.validate(pg.DBType(), true)
+}
+
+func (pg PostgresExternalDBConfig) ToMap() map[string]interface{} {
+	m := externalDBConfigMap(pg.Name, pg.DBType(), pg.ExternalDBCredentials)
+	if pg.SSLMode != "" {
+		m["credentials"].(map[string]interface{})["sslmode"] = pg.SSLMode
+	}
+	return m
+}
+
+//MySqlExternalDBConfig houses the connection information for a MySql external database
+type MySqlExternalDBConfig struct {
+	Name string
+	ExternalDBCredentials
+}
+
+func (my MySqlExternalDBConfig) DBType() string { return "mysql" }
+
+func (my MySqlExternalDBConfig) Validate() error {
+	if err := validateExternalDBName(my.DBType(), my.Name); err != nil {
+		return err
+	}
+	return my.validate(my.DBType(), true)
+}
+
+func (my MySqlExternalDBConfig) ToMap() map[string]interface{} {
+	return externalDBConfigMap(my.Name, my.DBType(), my.ExternalDBCredentials)
+}
+
+//MSSqlExternalDBConfig houses the connection information for a MSSql external database
+type MSSqlExternalDBConfig struct {
+	Name string
+	ExternalDBCredentials
+}
+
+func (ms MSSqlExternalDBConfig) DBType() string { return "mssql" }
+
+func (ms MSSqlExternalDBConfig) Validate() error {
+	if err := validateExternalDBName(ms.DBType(), ms.Name); err != nil {
+		return err
+	}
+	return ms.validate(ms.DBType(), true)
+}
+
+func (ms MSSqlExternalDBConfig) ToMap() map[string]interface{} {
+	return externalDBConfigMap(ms.Name, ms.DBType(), ms.ExternalDBCredentials)
+}
+
+//MongoDBExternalDBConfig houses the connection information for a MongoDB external database.
+//User and Password are optional for MongoDB. Its DBType is spelled "MongoDB", as the platform and connect collections spell it.
+type MongoDBExternalDBConfig struct {
+	Name string
+	ExternalDBCredentials
+}
+
+func (mg MongoDBExternalDBConfig) DBType() string { return "MongoDB" }
+
+func (mg MongoDBExternalDBConfig) Validate() error {
+	if err := validateExternalDBName(mg.DBType(), mg.Name); err != nil {
+		return err
+	}
+	return mg.validate(mg.DBType(), false)
+}
+
+func (mg MongoDBExternalDBConfig) ToMap() map[string]interface{} {
+	return externalDBConfigMap(mg.Name, mg.DBType(), mg.ExternalDBCredentials)
+}
+
+//ExternalDBOperation is implemented by the typed operation builders below. The platform runs a statement in the
+//database's own query language with positional arguments, so every operation is sent to PerformExternalDBOperation
+//as {"query": statement, "args": [arguments]}.
+type ExternalDBOperation interface {
+	Validate() error
+	ToMap() map[string]interface{}
+}
+
+//ExternalDBQuery is a raw statement against the external database, with positional parameters written in the
+//database's placeholder syntax. For MongoDB it is the only operation, the others write SQL.
+type ExternalDBQuery struct {
+	Query  string
+	Params []interface{}
+}
+
+//NewExternalDBQuery builds a query operation with the given positional parameters
+func NewExternalDBQuery(query string, params ...interface{}) *ExternalDBQuery {
+	return &ExternalDBQuery{Query: query, Params: params}
+}
+
+func (q *ExternalDBQuery) Validate() error {
+	if q.Query == "" {
+		return fmt.Errorf("External db query: Query is required")
+	}
+	return nil
+}
+
+func (q *ExternalDBQuery) ToMap() map[string]interface{} {
+	return externalDBStatement(q.Query, q.Params)
+}
+
+func externalDBStatement(query string, args []interface{}) map[string]interface{} {
+	if args == nil {
+		args = []interface{}{}
+	}
+	return map[string]interface{}{
+		"query": query,
+		"args":  args,
+	}
+}
+
+//externalDBDialect is how the SQL databases differ in the statements the builders write
+type externalDBDialect struct {
+	open, close string
+	placeholder func(n int) string
+}
+
+var externalDBDialects = map[string]*externalDBDialect{
+	"postgres": {`"`, `"`, func(n int) string { return "$" + strconv.Itoa(n) }},
+	"mysql":    {"`", "`", func(int) string { return "?" }},
+	"mssql":    {"[", "]", func(n int) string { return "@p" + strconv.Itoa(n) }},
+}
+
+var externalDBIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func externalDBDialectFor(op, dbtype string) (*externalDBDialect, error) {
+	dialect, ok := externalDBDialects[dbtype]
+	if !ok {
+		return nil, fmt.Errorf("External db %s: DBType must be postgres, mysql or mssql, got '%s'", op, dbtype)
+	}
+	return dialect, nil
+}
+
+func validateExternalDBIdentifier(op, kind, name string) error {
+	if !externalDBIdentifier.MatchString(name) {
+		return fmt.Errorf("External db %s: invalid %s name '%s'", op, kind, name)
+	}
+	return nil
+}
+
+func (dl *externalDBDialect) quote(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = dl.open + part + dl.close
+	}
+	return strings.Join(parts, ".")
+}
+
+//externalDBStatementBuilder collects the arguments of a statement as placeholders are written
+type externalDBStatementBuilder struct {
+	dialect *externalDBDialect
+	sql     strings.Builder
+	args    []interface{}
+}
+
+func (b *externalDBStatementBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return b.dialect.placeholder(len(b.args))
+}
+
+//where writes the filters of q as a WHERE clause. The filters of each group are and'ed, and the groups or'ed,
+//as the platform does for collections. Empty groups are skipped, and without filters there is no clause.
+func (b *externalDBStatementBuilder) where(q *Query) {
+	groups := []string{}
+	for _, filters := range q.Filters {
+		if len(filters) == 0 {
+			continue
+		}
+		conds := make([]string, len(filters))
+		for i, f := range filters {
+			column := b.dialect.quote(f.Field)
+			switch {
+			case f.Value == nil && f.Operator == "=":
+				conds[i] = column + " IS NULL"
+			case f.Value == nil:
+				conds[i] = column + " IS NOT NULL"
+			default:
+				conds[i] = column + " " + externalDBOperators[f.Operator] + " " + b.arg(f.Value)
+			}
+		}
+		groups = append(groups, "("+strings.Join(conds, " AND ")+")")
+	}
+	if len(groups) > 0 {
+		b.sql.WriteString(" WHERE " + strings.Join(groups, " OR "))
+	}
+}
+
+var externalDBOperators = map[string]string{
+	"=":  "=",
+	">":  ">",
+	"<":  "<",
+	">=": ">=",
+	"<=": "<=",
+	"!=": "<>",
+	"/=": "<>",
+}
+
+//validateExternalDBWhere checks that q can be written as SQL. Regular expression matches can't, they differ by database.
+func validateExternalDBWhere(op string, q *Query) error {
+	if q == nil {
+		return fmt.Errorf("External db %s: a Where query is required, use NewQuery() to %s every row", op, op)
+	}
+	for _, filters := range q.Filters {
+		for _, f := range filters {
+			if err := validateExternalDBIdentifier(op, "column", f.Field); err != nil {
+				return err
+			}
+			if _, ok := externalDBOperators[f.Operator]; !ok {
+				return fmt.Errorf("External db %s: operator '%s' on '%s' is not supported", op, f.Operator, f.Field)
+			}
+			if f.Value == nil && f.Operator != "=" && f.Operator != "!=" && f.Operator != "/=" {
+				return fmt.Errorf("External db %s: only = and != can compare '%s' with nil", op, f.Field)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+//ExternalDBInsert inserts rows into a table of a SQL external database, in a single statement.
+//Every row must have the same columns.
+type ExternalDBInsert struct {
+	//DBType is the DBType of the connection's config, postgres, mysql or mssql
+	DBType string
+	Table  string
+	Rows   []map[string]interface{}
+}
+
+//NewExternalDBInsert builds an insert operation on table
+func NewExternalDBInsert(dbtype, table string, rows ...map[string]interface{}) *ExternalDBInsert {
+	return &ExternalDBInsert{DBType: dbtype, Table: table, Rows: rows}
+}
+
+//Row adds a row to the insert
+func (i *ExternalDBInsert) Row(row map[string]interface{}) *ExternalDBInsert {
+	i.Rows = append(i.Rows, row)
+	return i
+}
+
+func (i *ExternalDBInsert) Validate() error {
+	if _, err := externalDBDialectFor("insert", i.DBType); err != nil {
+		return err
+	}
+	if err := validateExternalDBIdentifier("insert", "table", i.Table); err != nil {
+		return err
+	}
+	if len(i.Rows) == 0 {
+		return fmt.Errorf("External db insert: at least one row is required")
+	}
+	columns := sortedColumns(i.Rows[0])
+	if len(columns) == 0 {
+		return fmt.Errorf("External db insert: row 0 is empty")
+	}
+	for _, column := range columns {
+		if err := validateExternalDBIdentifier("insert", "column", column); err != nil {
+			return err
+		}
+	}
+	for idx, row := range i.Rows[1:] {
+		if len(row) != len(columns) {
+			return fmt.Errorf("External db insert: row %d has other columns than row 0", idx+1)
+		}
+		for _, column := range columns {
+			if _, ok := row[column]; !ok {
+				return fmt.Errorf("External db insert: row %d has other columns than row 0", idx+1)
+			}
+		}
+	}
+	return nil
+}
+
+func (i *ExternalDBInsert) ToMap() map[string]interface{} {
+	b := &externalDBStatementBuilder{dialect: externalDBDialects[i.DBType]}
+	columns := sortedColumns(i.Rows[0])
+	quoted := make([]string, len(columns))
+	for idx, column := range columns {
+		quoted[idx] = b.dialect.quote(column)
+	}
+	b.sql.WriteString("INSERT INTO " + b.dialect.quote(i.Table) + " (" + strings.Join(quoted, ", ") + ") VALUES ")
+	for r, row := range i.Rows {
+		if r > 0 {
+			b.sql.WriteString(", ")
+		}
+		values := make([]string, len(columns))
+		for idx, column := range columns {
+			values[idx] = b.arg(row[column])
+		}
+		b.sql.WriteString("(" + strings.Join(values, ", ") + ")")
+	}
+	return externalDBStatement(b.sql.String(), b.args)
+}
+
+//ExternalDBUpdate sets columns on the rows of a table of a SQL external database that match Where.
+//Only the filters of Where are used.
+type ExternalDBUpdate struct {
+	//DBType is the DBType of the connection's config, postgres, mysql or mssql
+	DBType  string
+	Table   string
+	Changes map[string]interface{}
+	Where   *Query
+}
+
+//NewExternalDBUpdate builds an update operation on table
+func NewExternalDBUpdate(dbtype, table string, where *Query, changes map[string]interface{}) *ExternalDBUpdate {
+	return &ExternalDBUpdate{DBType: dbtype, Table: table, Where: where, Changes: changes}
+}
+
+//Set adds a column change to the update
+func (u *ExternalDBUpdate) Set(column string, value interface{}) *ExternalDBUpdate {
+	if u.Changes == nil {
+		u.Changes = map[string]interface{}{}
+	}
+	u.Changes[column] = value
+	return u
+}
+
+func (u *ExternalDBUpdate) Validate() error {
+	if _, err := externalDBDialectFor("update", u.DBType); err != nil {
+		return err
+	}
+	if err := validateExternalDBIdentifier("update", "table", u.Table); err != nil {
+		return err
+	}
+	if len(u.Changes) == 0 {
+		return fmt.Errorf("External db update: at least one change is required")
+	}
+	for column := range u.Changes {
+		if err := validateExternalDBIdentifier("update", "column", column); err != nil {
+			return err
+		}
+	}
+	return validateExternalDBWhere("update", u.Where)
+}
+
+func (u *ExternalDBUpdate) ToMap() map[string]interface{} {
+	b := &externalDBStatementBuilder{dialect: externalDBDialects[u.DBType]}
+	columns := sortedColumns(u.Changes)
+	sets := make([]string, len(columns))
+	for idx, column := range columns {
+		sets[idx] = b.dialect.quote(column) + " = " + b.arg(u.Changes[column])
+	}
+	b.sql.WriteString("UPDATE " + b.dialect.quote(u.Table) + " SET " + strings.Join(sets, ", "))
+	b.where(u.Where)
+	return externalDBStatement(b.sql.String(), b.args)
+}
+
+//ExternalDBDelete removes the rows of a table of a SQL external database that match Where.
+//Only the filters of Where are used.
+type ExternalDBDelete struct {
+	//DBType is the DBType of the connection's config, postgres, mysql or mssql
+	DBType string
+	Table  string
+	Where  *Query
+}
+
+//NewExternalDBDelete builds a delete operation on table
+func NewExternalDBDelete(dbtype, table string, where *Query) *ExternalDBDelete {
+	return &ExternalDBDelete{DBType: dbtype, Table: table, Where: where}
+}
+
+func (d *ExternalDBDelete) Validate() error {
+	if _, err := externalDBDialectFor("delete", d.DBType); err != nil {
+		return err
+	}
+	if err := validateExternalDBIdentifier("delete", "table", d.Table); err != nil {
+		return err
+	}
+	return validateExternalDBWhere("delete", d.Where)
+}
+
+func (d *ExternalDBDelete) ToMap() map[string]interface{} {
+	b := &externalDBStatementBuilder{dialect: externalDBDialects[d.DBType]}
+	b.sql.WriteString("DELETE FROM " + b.dialect.quote(d.Table))
+	b.where(d.Where)
+	return externalDBStatement(b.sql.String(), b.args)
+}
+
+//ExternalDBResult is the typed result of an external db operation
+type ExternalDBResult struct {
+	Rows  []map[string]interface{}
+	Count int64
+	Raw   map[string]interface{}
+}
+
+//Decode unmarshals the result rows into v, which should be a pointer to a slice of structs or maps
+func (r *ExternalDBResult) Decode(v interface{}) error {
+	b, err := json.Marshal(r.Rows)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+//AddExternalDBConnectionConfig validates the config and creates the external db connection
+func (d *DevClient) AddExternalDBConnectionConfig(systemKey string, config ExternalDBConfig) error {
+	return addExternalDBConnectionConfig(d, systemKey, config)
+}
+
+//AddExternalDBConnectionConfig validates the config and creates the external db connection
+func (u *UserClient) AddExternalDBConnectionConfig(systemKey string, config ExternalDBConfig) error {
+	return addExternalDBConnectionConfig(u, systemKey, config)
+}
+
+//RunExternalDBOperation validates the operation, runs it against the named connection, and returns the typed result
+func (d *DevClient) RunExternalDBOperation(systemKey, name string, op ExternalDBOperation) (*ExternalDBResult, error) {
+	return runExternalDBOperation(d, systemKey, name, op)
+}
+
+//RunExternalDBOperation validates the operation, runs it against the named connection, and returns the typed result
+func (u *UserClient) RunExternalDBOperation(systemKey, name string, op ExternalDBOperation) (*ExternalDBResult, error) {
+	return runExternalDBOperation(u, systemKey, name, op)
+}
+
+func addExternalDBConnectionConfig(c cbClient, systemKey string, config ExternalDBConfig) error {
+	if config == nil {
+		return fmt.Errorf("External db config is required")
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	return addExternalDBConnection(c, systemKey, config.ToMap())
+}
+
+func runExternalDBOperation(c cbClient, systemKey, name string, op ExternalDBOperation) (*ExternalDBResult, error) {
+	if name == "" {
+		return nil, fmt.Errorf("External db connection name is required")
+	}
+	if op == nil {
+		return nil, fmt.Errorf("External db operation is required")
+	}
+	if err := op.Validate(); err != nil {
+		return nil, err
+	}
+	resp, err := performExternalDBOperation(c, systemKey, name, op.ToMap())
+	if err != nil {
+		return nil, err
+	}
+	return newExternalDBResult(resp)
+}
+
+func newExternalDBResult(resp map[string]interface{}) (*ExternalDBResult, error) {
+	rval := &ExternalDBResult{Raw: resp, Rows: []map[string]interface{}{}}
+	for _, key := range []string{"results", "rows", "DATA"} {
+		if rowsIF, ok := resp[key]; ok && rowsIF != nil {
+			rows, err := makeSliceOfMaps(rowsIF)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading external db result: %v", err)
+			}
+			rval.Rows = rows
+			break
+		}
+	}
+	rval.Count = int64(len(rval.Rows))
+	for _, key := range []string{"count", "rowsAffected"} {
+		if countIF, ok := resp[key]; ok && countIF != nil {
+			count, err := toInt64(countIF)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading external db result: %v", err)
+			}
+			rval.Count = count
+			break
+		}
+	}
+	return rval, nil
+}
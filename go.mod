@@ -6,6 +6,7 @@ require (
 	github.com/clearblade/go-utils v1.1.4
 	github.com/clearblade/mqtt_parsing v0.0.0-20160301165118-6ae49eac0961
 	github.com/clearblade/paho.mqtt.golang v1.1.1
+	github.com/eclipse/paho.golang v0.10.0
 	github.com/pkg/errors v0.8.1
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 )
@@ -0,0 +1,292 @@
+package GoSDK
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const _DEFAULT_HISTORY_PAGE_SIZE = 100
+
+//HistoryMessage is one entry of a system's message history, with the fields of the rows MessageHistory returns
+type HistoryMessage struct {
+	Topic   string
+	Payload []byte
+	Time    time.Time
+	QoS     int
+	UserID  string
+	IP      string
+	//Raw is the entry as returned by the platform
+	Raw map[string]interface{}
+}
+
+//HistoryFilter selects message history entries. Zero fields match everything.
+type HistoryFilter struct {
+	//Topic is a topic or an mqtt topic filter. Exact topics are filtered by the platform, filters with wildcards by the SDK.
+	Topic string
+	Start time.Time
+	Stop  time.Time
+	//UserID matches the user or device that published the message
+	UserID string
+	//PageSize is the number of entries requested from the platform per page. Defaults to 100.
+	PageSize int
+}
+
+//HistoryPager pages backwards through message history, newest entries first
+type HistoryPager struct {
+	client    *DevClient
+	systemKey string
+	filter    HistoryFilter
+	before    time.Time
+	count     int
+	seen      map[string]bool
+	done      bool
+}
+
+//MessageHistoryPager returns a pager over the message history entries of a system that match filter
+func (d *DevClient) MessageHistoryPager(systemKey string, filter HistoryFilter) *HistoryPager {
+	if filter.PageSize <= 0 {
+		filter.PageSize = _DEFAULT_HISTORY_PAGE_SIZE
+	}
+	return &HistoryPager{
+		client:    d,
+		systemKey: systemKey,
+		filter:    filter,
+		before:    filter.Stop,
+		count:     filter.PageSize,
+		seen:      map[string]bool{},
+	}
+}
+
+//FilterMessageHistory returns every message history entry of a system that matches filter, oldest first
+func (d *DevClient) FilterMessageHistory(systemKey string, filter HistoryFilter) ([]*HistoryMessage, error) {
+	p := d.MessageHistoryPager(systemKey, filter)
+	var all []*HistoryMessage
+	for {
+		page, err := p.Next()
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			break
+		}
+		all = append(all, page...)
+	}
+	sortHistory(all)
+	return all, nil
+}
+
+//Next returns the next page of matching entries, newest first. It returns nil once the history is exhausted.
+//Pages can hold fewer than PageSize entries when the SDK filters out entries the platform returned.
+//The platform pages by whole seconds, so when more than PageSize entries share one second the pager asks
+//for larger pages until it gets past that second. It returns an error if the platform won't return more.
+func (p *HistoryPager) Next() ([]*HistoryMessage, error) {
+	for !p.done {
+		rows, err := p.fetch()
+		if err != nil {
+			return nil, err
+		}
+		if p.count > p.filter.PageSize && len(rows) <= p.count/2 {
+			return nil, fmt.Errorf("Message history returned %d entries when asked for %d, can't page past the entries at %v", len(rows), p.count, p.before)
+		}
+		msgs := make([]*HistoryMessage, 0, len(rows))
+		oldest := p.before
+		for _, row := range rows {
+			msg, err := newHistoryMessage(row)
+			if err != nil {
+				return nil, err
+			}
+			if oldest.IsZero() || msg.Time.Before(oldest) {
+				oldest = msg.Time
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(rows) < p.count {
+			p.done = true
+		} else if !p.before.IsZero() && oldest.Unix() >= p.before.Unix() {
+			//a full page inside the boundary second, ask for more rather than skip the rest of it
+			p.count *= 2
+			continue
+		}
+		p.count = p.filter.PageSize
+		//entries from the boundary second come back on the next page too. Remember them to skip them there.
+		var page []*HistoryMessage
+		boundary := map[string]bool{}
+		for _, msg := range msgs {
+			key := historyKey(msg)
+			if msg.Time.Unix() == oldest.Unix() {
+				boundary[key] = true
+			}
+			if p.seen[key] || !p.filter.matches(msg) {
+				continue
+			}
+			page = append(page, msg)
+		}
+		p.seen = boundary
+		p.before = oldest
+		if !p.filter.Start.IsZero() && p.before.Before(p.filter.Start) {
+			p.done = true
+		}
+		if len(page) > 0 {
+			return page, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *HistoryPager) fetch() ([]map[string]interface{}, error) {
+	creds, err := p.client.credentials()
+	if err != nil {
+		return nil, err
+	}
+	query := map[string]string{
+		"count": strconv.Itoa(p.count),
+	}
+	if p.filter.Topic != "" && !strings.ContainsAny(p.filter.Topic, "+#") {
+		query["topic"] = p.filter.Topic
+	}
+	if !p.before.IsZero() {
+		query["last"] = strconv.FormatInt(p.before.Unix(), 10)
+	}
+	if !p.filter.Start.IsZero() {
+		query["start"] = strconv.FormatInt(p.filter.Start.Unix(), 10)
+	}
+	if !p.filter.Stop.IsZero() {
+		query["stop"] = strconv.FormatInt(p.filter.Stop.Unix(), 10)
+	}
+	resp, err := get(p.client, _MH_PREAMBLE+p.systemKey, query, creds, nil)
+	resp, err = mapResponse(resp, err)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting message history: %v", err)
+	}
+	body, ok := resp.Body.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Message history returned %T, expecting a list", resp.Body)
+	}
+	return convertToMapStringInterface(body)
+}
+
+func (f *HistoryFilter) matches(msg *HistoryMessage) bool {
+	if f.Topic != "" && !TopicMatches(f.Topic, msg.Topic) {
+		return false
+	}
+	if !f.Start.IsZero() && msg.Time.Before(f.Start) {
+		return false
+	}
+	if !f.Stop.IsZero() && msg.Time.After(f.Stop) {
+		return false
+	}
+	if f.UserID != "" && msg.UserID != f.UserID {
+		return false
+	}
+	return true
+}
+
+func newHistoryMessage(row map[string]interface{}) (*HistoryMessage, error) {
+	msg := &HistoryMessage{Raw: row}
+	msg.Topic, _ = row["topicid"].(string)
+	msg.UserID, _ = row["userid"].(string)
+	msg.IP, _ = row["ip"].(string)
+	switch p := row["payload"].(type) {
+	case string:
+		msg.Payload = []byte(p)
+	case nil:
+	default:
+		msg.Payload = []byte(fmt.Sprint(p))
+	}
+	if q, ok := row["qos"]; ok && q != nil {
+		qos, err := toInt64(q)
+		if err != nil {
+			return nil, fmt.Errorf("Bad qos in message history: %v", err)
+		}
+		msg.QoS = int(qos)
+	}
+	if t, ok := row["time"]; ok && t != nil {
+		ts, err := ParseTimestamp(t)
+		if err != nil {
+			return nil, fmt.Errorf("Bad time in message history: %v", err)
+		}
+		msg.Time = ts
+	}
+	return msg, nil
+}
+
+func historyKey(msg *HistoryMessage) string {
+	return fmt.Sprintf("%d|%s|%s|%s|%x", msg.Time.UnixNano(), msg.Topic, msg.UserID, msg.IP, msg.Payload)
+}
+
+func sortHistory(msgs []*HistoryMessage) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+}
+
+//ReplayOptions controls how ReplayHistory republishes messages
+type ReplayOptions struct {
+	//Target is the topic messages are republished to. When empty, Rewrite is used, or else the original topic.
+	Target string
+	//Rewrite maps an original topic to the topic it is republished to
+	Rewrite func(topic string) string
+	//Qos overrides the original qos when OverrideQos is set
+	Qos         int
+	OverrideQos bool
+	//Paced waits between messages as long as elapsed between them originally, divided by Speed
+	Paced bool
+	//Speed scales the pacing, 2 replays twice as fast. Defaults to 1.
+	Speed float64
+	//Done stops the replay when closed
+	Done <-chan struct{}
+}
+
+//HistoryPublisher is what ReplayHistory publishes through. UserClient, DeviceClient and DevClient implement it,
+//so replayed messages go through the same checks as the client's other publishes.
+type HistoryPublisher interface {
+	Publish(topic string, message []byte, qos int) error
+}
+
+//ReplayHistory republishes msgs, oldest first, through c. It returns the number of messages published.
+func ReplayHistory(c HistoryPublisher, msgs []*HistoryMessage, opts ReplayOptions) (int, error) {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	ordered := append([]*HistoryMessage{}, msgs...)
+	sortHistory(ordered)
+	sent := 0
+	for i, msg := range ordered {
+		if opts.Paced && i > 0 {
+			gap := time.Duration(float64(msg.Time.Sub(ordered[i-1].Time)) / opts.Speed)
+			if gap > 0 {
+				timer := time.NewTimer(gap)
+				select {
+				case <-timer.C:
+				case <-opts.Done:
+					timer.Stop()
+					return sent, nil
+				}
+			}
+		}
+		select {
+		case <-opts.Done:
+			return sent, nil
+		default:
+		}
+		topic := msg.Topic
+		switch {
+		case opts.Target != "":
+			topic = opts.Target
+		case opts.Rewrite != nil:
+			topic = opts.Rewrite(msg.Topic)
+		}
+		qos := msg.QoS
+		if opts.OverrideQos {
+			qos = opts.Qos
+		}
+		if err := c.Publish(topic, msg.Payload, qos); err != nil {
+			return sent, fmt.Errorf("Error replaying message %d: %v", i, err)
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,396 @@
+package GoSDK
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	_DEFAULT_INGEST_BATCH_SIZE     = 100
+	_DEFAULT_INGEST_FLUSH_INTERVAL = 5 * time.Second
+	_DEFAULT_INGEST_RETRIES        = 5
+	_DEFAULT_INGEST_BACKOFF        = time.Second
+)
+
+//IngestMapper turns a message into a collection row. Returning a nil row skips the message.
+type IngestMapper func(topic string, payload []byte) (map[string]interface{}, error)
+
+//IngestOptions configures an Ingester
+type IngestOptions struct {
+	CollectionID string
+	//Topics are the topic filters to subscribe to
+	Topics []string
+	Qos    int
+	//Map turns messages into rows. When nil the payload must be a JSON object, which is inserted as is.
+	Map IngestMapper
+	//BatchSize is the number of rows inserted at once. Defaults to 100.
+	BatchSize int
+	//FlushInterval bounds how long a row waits for its batch to fill. Defaults to 5 seconds.
+	FlushInterval time.Duration
+	//MaxRetries is the number of times a failed batch is retried per flush, doubling RetryBackoff
+	//in between. Rows of a batch that still fails are kept and tried again on the next flush. Defaults to 5.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	//JournalPath is the file rows are written to before the message handler returns, and removed from once
+	//their batch is committed. Rows left by a crashed process are inserted first. When empty rows are only held in memory.
+	JournalPath string
+	//OnError is called for messages that can't be mapped or journaled, and batches that can't be inserted.
+	//They are ignored if it is nil.
+	OnError func(error)
+	//Options applies to the underlying subscriptions
+	Options SubscribeOptions
+}
+
+//IngestStats counts what an Ingester has done
+type IngestStats struct {
+	Received uint64
+	Inserted uint64
+	Skipped  uint64
+	//FailedBatches counts insert attempts that failed, including ones that later succeeded on retry
+	FailedBatches uint64
+	Pending       int
+}
+
+//Ingester writes the messages published to a set of topics into a collection, in batches.
+//
+//With JournalPath set, each row is synced to the journal before its message handler returns, and stays there
+//until its batch is committed, so rows survive a crash once the handler has returned. Whether a message can be
+//lost depends on when it is acknowledged to the broker:
+//
+//An Mqtt5Client, used by IngestMQTT5, acknowledges qos 1 and 2 messages after the handler returns, so the broker
+//redelivers any message whose row didn't reach the journal because the process died. A row the journal can't
+//take, on a full disk for example, is reported to OnError and its message is acknowledged all the same.
+//
+//The 3.1.1 mqtt library behind MqttClient, used by Ingest, acknowledges qos 1 messages before the handler runs.
+//A crash between the acknowledgement and the journal write loses that message, and nothing on the client can
+//close that gap. Use IngestMQTT5 where that matters.
+type Ingester struct {
+	client   cbClient
+	opts     IngestOptions
+	subs     []*Subscription
+	mqtt5    Mqtt5Client
+	lock     sync.Mutex
+	flushing sync.Mutex
+	rows     []map[string]interface{}
+	journal  *journal
+	kick     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	received uint64
+	inserted uint64
+	skipped  uint64
+	failed   uint64
+}
+
+//Ingest subscribes to opts.Topics through the client's mqtt connection and inserts every message into opts.CollectionID
+func (u *UserClient) Ingest(opts IngestOptions) (*Ingester, error) {
+	return newIngester(u, u.guardedMqtt(), opts)
+}
+
+//Ingest subscribes to opts.Topics through the client's mqtt connection and inserts every message into opts.CollectionID
+func (d *DeviceClient) Ingest(opts IngestOptions) (*Ingester, error) {
+	return newIngester(d, d.guardedMqtt(), opts)
+}
+
+//Ingest subscribes to opts.Topics through the client's mqtt connection and inserts every message into opts.CollectionID
+func (d *DevClient) Ingest(opts IngestOptions) (*Ingester, error) {
+	return newIngester(d, d.MQTTClient, opts)
+}
+
+//IngestMQTT5 subscribes to opts.Topics through mqc and inserts every message into opts.CollectionID.
+//Messages are only acknowledged once their row is in the journal, so set opts.JournalPath.
+func (u *UserClient) IngestMQTT5(mqc Mqtt5Client, opts IngestOptions) (*Ingester, error) {
+	return newIngesterMQTT5(u, mqc, opts)
+}
+
+//IngestMQTT5 subscribes to opts.Topics through mqc and inserts every message into opts.CollectionID.
+//Messages are only acknowledged once their row is in the journal, so set opts.JournalPath.
+func (d *DeviceClient) IngestMQTT5(mqc Mqtt5Client, opts IngestOptions) (*Ingester, error) {
+	return newIngesterMQTT5(d, mqc, opts)
+}
+
+//IngestMQTT5 subscribes to opts.Topics through mqc and inserts every message into opts.CollectionID.
+//Messages are only acknowledged once their row is in the journal, so set opts.JournalPath.
+func (d *DevClient) IngestMQTT5(mqc Mqtt5Client, opts IngestOptions) (*Ingester, error) {
+	return newIngesterMQTT5(d, mqc, opts)
+}
+
+func newIngester(c cbClient, mqc MqttClient, opts IngestOptions) (*Ingester, error) {
+	in, err := startIngester(c, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range in.opts.Topics {
+		sub, err := subscribeWithOptions(mqc, topic, in.opts.Qos, in.opts.Options, func(msg *mqttTypes.Publish) {
+			in.receive(msg.Topic.Whole, msg.Payload)
+		})
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("Error subscribing to '%s': %v", topic, err)
+		}
+		in.subs = append(in.subs, sub)
+	}
+	return in, nil
+}
+
+func newIngesterMQTT5(c cbClient, mqc Mqtt5Client, opts IngestOptions) (*Ingester, error) {
+	if mqc == nil {
+		return nil, fmt.Errorf("An MQTT 5 client is required")
+	}
+	in, err := startIngester(c, opts)
+	if err != nil {
+		return nil, err
+	}
+	in.mqtt5 = mqc
+	for i, topic := range in.opts.Topics {
+		err := mqc.Subscribe(topic, in.opts.Qos, func(msg *Mqtt5Message) {
+			in.receive(msg.Topic, msg.Payload)
+		})
+		if err != nil {
+			//only unsubscribe from the topics subscribed to so far
+			in.opts.Topics = in.opts.Topics[:i]
+			in.Close()
+			return nil, fmt.Errorf("Error subscribing to '%s': %v", topic, err)
+		}
+	}
+	return in, nil
+}
+
+//startIngester checks opts, reads back the journal and starts flushing, ready for messages
+func startIngester(c cbClient, opts IngestOptions) (*Ingester, error) {
+	if opts.CollectionID == "" {
+		return nil, fmt.Errorf("CollectionID is required")
+	}
+	if len(opts.Topics) == 0 {
+		return nil, fmt.Errorf("At least one topic is required")
+	}
+	if opts.Map == nil {
+		opts.Map = ingestJSONObject
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = _DEFAULT_INGEST_BATCH_SIZE
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = _DEFAULT_INGEST_FLUSH_INTERVAL
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = _DEFAULT_INGEST_RETRIES
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = _DEFAULT_INGEST_BACKOFF
+	}
+	in := &Ingester{
+		client: c,
+		opts:   opts,
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := in.openJournal(); err != nil {
+		return nil, err
+	}
+	go in.run()
+	return in, nil
+}
+
+func ingestJSONObject(topic string, payload []byte) (map[string]interface{}, error) {
+	row := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &row); err != nil {
+		return nil, fmt.Errorf("Payload on '%s' is not a JSON object: %v", topic, err)
+	}
+	return row, nil
+}
+
+//Stats returns the ingester's counters
+func (in *Ingester) Stats() IngestStats {
+	in.lock.Lock()
+	pending := len(in.rows)
+	in.lock.Unlock()
+	return IngestStats{
+		Received:      atomic.LoadUint64(&in.received),
+		Inserted:      atomic.LoadUint64(&in.inserted),
+		Skipped:       atomic.LoadUint64(&in.skipped),
+		FailedBatches: atomic.LoadUint64(&in.failed),
+		Pending:       pending,
+	}
+}
+
+//Flush inserts every pending row now
+func (in *Ingester) Flush() error {
+	return in.flush(true)
+}
+
+//Close unsubscribes, then inserts the rows still pending. Rows that can't be inserted stay in the journal.
+func (in *Ingester) Close() error {
+	var err error
+	in.stopOnce.Do(func() {
+		for _, sub := range in.subs {
+			sub.Unsubscribe()
+		}
+		if in.mqtt5 != nil && len(in.opts.Topics) > 0 {
+			in.mqtt5.Unsubscribe(in.opts.Topics...)
+		}
+		close(in.stop)
+		<-in.done
+		err = in.flush(true)
+		in.lock.Lock()
+		defer in.lock.Unlock()
+		if in.journal != nil {
+			in.journal.close()
+		}
+	})
+	return err
+}
+
+func (in *Ingester) receive(topic string, payload []byte) {
+	atomic.AddUint64(&in.received, 1)
+	row, err := in.opts.Map(topic, payload)
+	if err != nil {
+		atomic.AddUint64(&in.skipped, 1)
+		in.fail(err)
+		return
+	}
+	if row == nil {
+		atomic.AddUint64(&in.skipped, 1)
+		return
+	}
+	in.lock.Lock()
+	if err := in.journalRow(row); err != nil {
+		in.lock.Unlock()
+		in.fail(err)
+		return
+	}
+	in.rows = append(in.rows, row)
+	full := len(in.rows) >= in.opts.BatchSize
+	in.lock.Unlock()
+	if full {
+		select {
+		case in.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (in *Ingester) run() {
+	defer close(in.done)
+	ticker := time.NewTicker(in.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			in.flush(true)
+		case <-in.kick:
+			in.flush(false)
+		case <-in.stop:
+			return
+		}
+	}
+}
+
+//flush inserts full batches, and the last partial one too when all is set
+func (in *Ingester) flush(all bool) error {
+	in.flushing.Lock()
+	defer in.flushing.Unlock()
+	for {
+		in.lock.Lock()
+		n := len(in.rows)
+		if n > in.opts.BatchSize {
+			n = in.opts.BatchSize
+		}
+		if n == 0 || (!all && n < in.opts.BatchSize) {
+			in.lock.Unlock()
+			return nil
+		}
+		batch := append([]map[string]interface{}{}, in.rows[:n]...)
+		in.lock.Unlock()
+		if err := in.insert(batch); err != nil {
+			in.fail(err)
+			return err
+		}
+		atomic.AddUint64(&in.inserted, uint64(n))
+		in.lock.Lock()
+		//rows are only ever removed here, so the batch is still at the front
+		in.rows = append([]map[string]interface{}{}, in.rows[n:]...)
+		err := in.rewriteJournal()
+		in.lock.Unlock()
+		if err != nil {
+			in.fail(err)
+			return err
+		}
+	}
+}
+
+func (in *Ingester) insert(batch []map[string]interface{}) error {
+	backoff := in.opts.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= in.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-in.stop:
+				//closing, leave the batch for the final flush
+				return fmt.Errorf("Error inserting batch of %d rows into %s: %v", len(batch), in.opts.CollectionID, err)
+			}
+			backoff *= 2
+		}
+		if _, err = insertdata(in.client, in.opts.CollectionID, batch); err == nil {
+			return nil
+		}
+		atomic.AddUint64(&in.failed, 1)
+	}
+	return fmt.Errorf("Error inserting batch of %d rows into %s: %v", len(batch), in.opts.CollectionID, err)
+}
+
+func (in *Ingester) fail(err error) {
+	if in.opts.OnError != nil {
+		in.opts.OnError(err)
+	}
+}
+
+//openJournal reads back the rows a previous process left uncommitted and opens the journal for appending
+func (in *Ingester) openJournal() error {
+	if in.opts.JournalPath == "" {
+		return nil
+	}
+	j, err := openJournal(in.opts.JournalPath, "ingest journal", func(line []byte) error {
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		row := map[string]interface{}{}
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
+		in.rows = append(in.rows, row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	in.journal = j
+	return in.rewriteJournal()
+}
+
+//journalRow appends row to the journal, the caller must hold the lock
+func (in *Ingester) journalRow(row map[string]interface{}) error {
+	if in.journal == nil {
+		return nil
+	}
+	if in.journal.closed() {
+		return fmt.Errorf("Ingest journal is closed")
+	}
+	return in.journal.append(row)
+}
+
+//rewriteJournal replaces the journal with the rows still pending, the caller must hold the lock
+func (in *Ingester) rewriteJournal() error {
+	if in.journal == nil {
+		return nil
+	}
+	return in.journal.rewrite(len(in.rows), func(i int) interface{} { return in.rows[i] })
+}
@@ -0,0 +1,123 @@
+package GoSDK
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//journal is a file of JSON lines that entries are appended to, synced, before they are acted on, and that is
+//rewritten with the entries still pending once some are done with. OfflineQueue and Ingester keep their
+//pending messages and rows in one, so they survive a crash.
+type journal struct {
+	path string
+	//name describes the journal in errors
+	name string
+	file *os.File
+}
+
+//openJournal reads back the entries a previous process left in the file at path, passing each line to decode.
+//If decode fails on the last line it is skipped, as a torn write from a crash. Failing on any other line is
+//an error, since the file is then damaged in a way a crash can't explain.
+//The journal can't be appended to until rewrite has been called with the entries decode kept.
+func openJournal(path, name string, decode func(line []byte) error) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Error creating %s directory: %v", name, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %v", name, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	var torn error
+	for line := 1; scanner.Scan(); line++ {
+		if torn != nil {
+			return nil, torn
+		}
+		if err := decode(scanner.Bytes()); err != nil {
+			torn = fmt.Errorf("Error reading %s: bad entry on line %d: %v", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", name, err)
+	}
+	return &journal{path: path, name: name}, nil
+}
+
+//closed reports whether the journal can't be appended to
+func (j *journal) closed() bool {
+	return j.file == nil
+}
+
+//append writes v as a line and syncs the file
+func (j *journal) append(v interface{}) error {
+	if j.file == nil {
+		return fmt.Errorf("%s is closed", j.name)
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error encoding %s entry: %v", j.name, err)
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Error writing %s: %v", j.name, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("Error writing %s: %v", j.name, err)
+	}
+	return nil
+}
+
+//rewrite replaces the file with the n entries returned by entry, through a temporary file renamed over it.
+//If it fails the old file is left in place, and entries the caller has already let go of would be read
+//back again by the next process.
+func (j *journal) rewrite(n int, entry func(i int) interface{}) error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error rewriting %s: %v", j.name, err)
+	}
+	w := bufio.NewWriter(tmp)
+	for i := 0; i < n; i++ {
+		line, err := json.Marshal(entry(i))
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("Error rewriting %s: %v", j.name, err)
+		}
+		w.Write(append(line, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, j.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Error rewriting %s: %v", j.name, err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Error opening %s for writing: %v", j.name, err)
+	}
+	return nil
+}
+
+//close closes the file. Entries still in it are read back by the next openJournal.
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
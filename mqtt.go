@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"time"
+	"unicode/utf8"
 
 	mqttTypes "github.com/clearblade/mqtt_parsing"
 	mqtt "github.com/clearblade/paho.mqtt.golang"
@@ -46,7 +48,7 @@ func (b *client) NewClientID() string {
 
 //InitializeMQTT allocates the mqtt client for the user. an empty string can be passed as the second argument for the user client
 func (u *UserClient) InitializeMQTT(clientid string, ignore string, timeout int, ssl *tls.Config, lastWill *LastWillPacket) error {
-	mqc, err := newMqttClient(u.UserToken, u.SystemKey, u.SystemSecret, clientid, timeout, u.MqttAddr, ssl, lastWill)
+	mqc, err := newMqttClient(u.UserToken, u.SystemKey, u.SystemSecret, clientid, timeout, u.MqttAddr, ssl, lastWill, u.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -55,7 +57,7 @@ func (u *UserClient) InitializeMQTT(clientid string, ignore string, timeout int,
 }
 
 func (u *UserClient) InitializeMQTTWithCallback(clientid string, ignore string, timeout int, ssl *tls.Config, lastWill *LastWillPacket, callbacks *Callbacks) error {
-	mqc, err := newMqttClientWithCallbacks(u.UserToken, u.SystemKey, u.SystemSecret, clientid, timeout, u.MqttAddr, ssl, lastWill, callbacks)
+	mqc, err := newMqttClientWithCallbacks(u.UserToken, u.SystemKey, u.SystemSecret, clientid, timeout, u.MqttAddr, ssl, lastWill, callbacks, u.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -64,7 +66,7 @@ func (u *UserClient) InitializeMQTTWithCallback(clientid string, ignore string,
 }
 
 func (u *UserClient) AuthenticateMQTT(username, password, systemKey, systemSecret string, timeout int, ssl *tls.Config) error {
-	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, u.MqttAuthAddr, ssl)
+	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, u.MqttAuthAddr, ssl, u.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -89,7 +91,7 @@ func (u *UserClient) AuthenticateMQTT(username, password, systemKey, systemSecre
 //topics are isolated across systems, so in order to communicate with a specific
 //system, you must supply the system key
 func (d *DevClient) InitializeMQTT(clientid, systemkey string, timeout int, ssl *tls.Config, lastWill *LastWillPacket) error {
-	mqc, err := newMqttClient(d.DevToken, systemkey, "", clientid, timeout, d.MqttAddr, ssl, lastWill)
+	mqc, err := newMqttClient(d.DevToken, systemkey, "", clientid, timeout, d.MqttAddr, ssl, lastWill, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -98,7 +100,7 @@ func (d *DevClient) InitializeMQTT(clientid, systemkey string, timeout int, ssl
 }
 
 func (d *DevClient) InitializeMQTTWithCallback(clientid, systemkey string, timeout int, ssl *tls.Config, lastWill *LastWillPacket, callbacks *Callbacks) error {
-	mqc, err := newMqttClientWithCallbacks(d.DevToken, systemkey, "", clientid, timeout, d.MqttAddr, ssl, lastWill, callbacks)
+	mqc, err := newMqttClientWithCallbacks(d.DevToken, systemkey, "", clientid, timeout, d.MqttAddr, ssl, lastWill, callbacks, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -107,7 +109,7 @@ func (d *DevClient) InitializeMQTTWithCallback(clientid, systemkey string, timeo
 }
 
 func (d *DevClient) AuthenticateMQTT(username, password, systemKey, systemSecret string, timeout int, ssl *tls.Config) error {
-	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, d.MqttAuthAddr, ssl)
+	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, d.MqttAuthAddr, ssl, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -129,7 +131,7 @@ func (d *DevClient) AuthenticateMQTT(username, password, systemKey, systemSecret
 
 //InitializeMQTT allocates the mqtt client for the user. an empty string can be passed as the second argument for the user client
 func (d *DeviceClient) InitializeMQTT(clientid string, ignore string, timeout int, ssl *tls.Config, lastWill *LastWillPacket) error {
-	mqc, err := newMqttClient(d.DeviceToken, d.SystemKey, d.SystemSecret, clientid, timeout, d.MqttAddr, ssl, lastWill)
+	mqc, err := newMqttClient(d.DeviceToken, d.SystemKey, d.SystemSecret, d.sessionClientID(clientid), timeout, d.MqttAddr, ssl, lastWill, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -138,7 +140,7 @@ func (d *DeviceClient) InitializeMQTT(clientid string, ignore string, timeout in
 }
 
 func (d *DeviceClient) InitializeMQTTWithCallback(clientid string, ignore string, timeout int, ssl *tls.Config, lastWill *LastWillPacket, callbacks *Callbacks) error {
-	mqc, err := newMqttClientWithCallbacks(d.DeviceToken, d.SystemKey, d.SystemSecret, clientid, timeout, d.MqttAddr, ssl, lastWill, callbacks)
+	mqc, err := newMqttClientWithCallbacks(d.DeviceToken, d.SystemKey, d.SystemSecret, d.sessionClientID(clientid), timeout, d.MqttAddr, ssl, lastWill, callbacks, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -147,7 +149,7 @@ func (d *DeviceClient) InitializeMQTTWithCallback(clientid string, ignore string
 }
 
 func (d *DeviceClient) AuthenticateMQTT(username, password, systemKey, systemSecret string, timeout int, ssl *tls.Config) error {
-	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, d.MqttAuthAddr, ssl)
+	mqc, err := newMqttAuthClient(username, password, systemKey, systemSecret, timeout, d.MqttAuthAddr, ssl, d.connectOptions())
 	if err != nil {
 		return err
 	}
@@ -168,13 +170,27 @@ func (d *DeviceClient) AuthenticateMQTT(username, password, systemKey, systemSec
 	return nil
 }
 
-//Publish publishes a message to the specified mqtt topic
+//Publish publishes a message to the specified mqtt topic. With the offline queue enabled,
+//messages published while disconnected are queued and sent once the client reconnects.
 func (u *UserClient) Publish(topic string, message []byte, qos int) error {
+	if err := u.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	if u.offlineQueue != nil {
+		return u.offlineQueue.publish(u.MQTTClient, topic, message, qos)
+	}
 	return publish(u.MQTTClient, topic, message, qos, u.getMessageId())
 }
 
-//Publish publishes a message to the specified mqtt topic
+//Publish publishes a message to the specified mqtt topic. With the offline queue enabled,
+//messages published while disconnected are queued and sent once the client reconnects.
 func (d *DeviceClient) Publish(topic string, message []byte, qos int) error {
+	if err := d.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	if d.offlineQueue != nil {
+		return d.offlineQueue.publish(d.MQTTClient, topic, message, qos)
+	}
 	return publish(d.MQTTClient, topic, message, qos, d.getMessageId())
 }
 
@@ -183,6 +199,22 @@ func (d *DevClient) Publish(topic string, message []byte, qos int) error {
 	return publish(d.MQTTClient, topic, message, qos, d.getMessageId())
 }
 
+//PublishHttp publishes a message through the platform's REST api instead of the mqtt connection
+func (u *UserClient) PublishHttp(systemKey, topic string, message []byte, qos int) error {
+	if err := u.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	return publishHttp(u, systemKey, topic, message, qos)
+}
+
+//PublishHttp publishes a message through the platform's REST api instead of the mqtt connection
+func (d *DeviceClient) PublishHttp(systemKey, topic string, message []byte, qos int) error {
+	if err := d.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	return publishHttp(d, systemKey, topic, message, qos)
+}
+
 func (d *DevClient) PublishHttp(systemKey, topic string, message []byte, qos int) error {
 	creds, err := d.credentials()
 	if err != nil {
@@ -200,14 +232,56 @@ func (d *DevClient) PublishHttp(systemKey, topic string, message []byte, qos int
 	return nil
 }
 
+//PublishWithFallback publishes over mqtt while the client is connected and over http otherwise.
+//If the http publish fails too and the offline queue is enabled, the message is queued.
+func (u *UserClient) PublishWithFallback(systemKey, topic string, message []byte, qos int) error {
+	if err := u.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	if u.MQTTClient != nil && u.MQTTClient.IsConnected() {
+		return u.Publish(topic, message, qos)
+	}
+	err := publishHttp(u, systemKey, topic, message, qos)
+	if err != nil && u.offlineQueue != nil {
+		return u.Publish(topic, message, qos)
+	}
+	return err
+}
+
+//PublishWithFallback publishes over mqtt while the client is connected and over http otherwise.
+//If the http publish fails too and the offline queue is enabled, the message is queued.
+func (d *DeviceClient) PublishWithFallback(systemKey, topic string, message []byte, qos int) error {
+	if err := d.topicGuard.CheckPublish(topic); err != nil {
+		return err
+	}
+	if d.MQTTClient != nil && d.MQTTClient.IsConnected() {
+		return d.Publish(topic, message, qos)
+	}
+	err := publishHttp(d, systemKey, topic, message, qos)
+	if err != nil && d.offlineQueue != nil {
+		return d.Publish(topic, message, qos)
+	}
+	return err
+}
+
+//PublishWithFallback publishes over mqtt while the client is connected and over http otherwise.
+//The http path is PublishHttp, which unlike the user and device clients' doesn't refuse payloads that are
+//not valid utf-8 or report the platform's error responses, as it always has.
+func (d *DevClient) PublishWithFallback(systemKey, topic string, message []byte, qos int) error {
+	if d.MQTTClient != nil && d.MQTTClient.IsConnected() {
+		return d.Publish(topic, message, qos)
+	}
+	return d.PublishHttp(systemKey, topic, message, qos)
+}
+
 //Subscribe subscribes a user to a topic. Incoming messages will be sent over the channel.
 func (u *UserClient) Subscribe(topic string, qos int) (<-chan *mqttTypes.Publish, error) {
-	return subscribe(u.MQTTClient, topic, qos)
+	return subscribe(u.guardedMqtt(), topic, qos)
 }
 
 //Subscribe subscribes a device to a topic. Incoming messages will be sent over the channel.
 func (d *DeviceClient) Subscribe(topic string, qos int) (<-chan *mqttTypes.Publish, error) {
-	return subscribe(d.MQTTClient, topic, qos)
+	return subscribe(d.guardedMqtt(), topic, qos)
 }
 
 //Subscribe subscribes a user to a topic. Incoming messages will be sent over the channel.
@@ -276,43 +350,53 @@ type mqttBaseClient struct {
 	address                                  string
 	token, systemKey, systemSecret, clientID string
 	timeout                                  int
+	subs                                     *subscriptionRegistry
+	watcher                                  *connectionWatcher
+	bridge                                   io.Closer
+}
+
+func newMqttBaseClient(address, token, systemkey, systemsecret, clientid string, timeout int) *mqttBaseClient {
+	return &mqttBaseClient{
+		address:      address,
+		token:        token,
+		systemKey:    systemkey,
+		systemSecret: systemsecret,
+		clientID:     clientid,
+		timeout:      timeout,
+		subs:         newSubscriptionRegistry(),
+		watcher:      &connectionWatcher{},
+	}
+}
+
+//Disconnect closes the connection, the channels of every subscription made through it, and its connection event channels
+func (m *mqttBaseClient) Disconnect(quiesce uint) {
+	m.Client.Disconnect(quiesce)
+	m.subs.removeAll()
+	m.watcher.close()
+	m.closeBridge()
+}
+
+func (m *mqttBaseClient) closeBridge() {
+	if m.bridge != nil {
+		m.bridge.Close()
+		m.bridge = nil
+	}
 }
 
 //InitializeMqttClient allocates a mqtt client.
 //the values for initialization are drawn from the client struct
 //with the exception of the timeout and client id, which is mqtt specific.
 // timeout refers to broker connect timeout
-func newMqttClient(token, systemkey, systemsecret, clientid string, timeout int, address string, ssl *tls.Config, lastWill *LastWillPacket) (MqttClient, error) {
-	o := mqtt.NewClientOptions()
-	o.SetAutoReconnect(true)
-	if ssl != nil {
-		o.AddBroker("tls://" + address)
-		o.SetTLSConfig(ssl)
-	} else {
-		o.AddBroker("tcp://" + address)
-	}
-	o.SetClientID(clientid)
-	o.SetUsername(token)
-	o.SetPassword(systemkey)
-	o.SetConnectTimeout(time.Duration(timeout) * time.Second)
-	if lastWill != nil {
-		o.SetWill(lastWill.Topic, lastWill.Body, uint8(lastWill.Qos), lastWill.Retain)
-	}
-	cli := mqtt.NewClient(o)
-	mqc := &mqttBaseClient{cli, address, token, systemkey, systemsecret, clientid, timeout}
-	ret := mqc.Connect()
-	ret.Wait()
-	return mqc, ret.Error()
+func newMqttClient(token, systemkey, systemsecret, clientid string, timeout int, address string, ssl *tls.Config, lastWill *LastWillPacket, conn *mqttConnectOptions) (MqttClient, error) {
+	return newMqttClientWithCallbacks(token, systemkey, systemsecret, clientid, timeout, address, ssl, lastWill, nil, conn)
 }
 
-func newMqttClientWithCallbacks(token, systemkey, systemsecret, clientid string, timeout int, address string, ssl *tls.Config, lastWill *LastWillPacket, callbacks *Callbacks) (MqttClient, error) {
+func newMqttClientWithCallbacks(token, systemkey, systemsecret, clientid string, timeout int, address string, ssl *tls.Config, lastWill *LastWillPacket, callbacks *Callbacks, conn *mqttConnectOptions) (MqttClient, error) {
 	o := mqtt.NewClientOptions()
 	o.SetAutoReconnect(true)
-	if ssl != nil {
-		o.AddBroker("tls://" + address)
-		o.SetTLSConfig(ssl)
-	} else {
-		o.AddBroker("tcp://" + address)
+	bridge, unsent, err := conn.apply(o, address, ssl, clientid, false)
+	if err != nil {
+		return nil, err
 	}
 	o.SetClientID(clientid)
 	o.SetUsername(token)
@@ -321,39 +405,43 @@ func newMqttClientWithCallbacks(token, systemkey, systemsecret, clientid string,
 	if lastWill != nil {
 		o.SetWill(lastWill.Topic, lastWill.Body, uint8(lastWill.Qos), lastWill.Retain)
 	}
-	if callbacks.OnConnectionLostCallback != nil {
-		o.SetConnectionLostHandler(callbacks.OnConnectionLostCallback)
-	}
-	if callbacks.OnConnectCallback != nil {
-		o.SetOnConnectHandler(callbacks.OnConnectCallback)
-	}
-	cli := mqtt.NewClient(o)
-	mqc := &mqttBaseClient{cli, address, token, systemkey, systemsecret, clientid, timeout}
+	mqc := newMqttBaseClient(address, token, systemkey, systemsecret, clientid, timeout)
+	mqc.bridge = bridge
+	mqc.watchConnection(o, callbacks)
+	mqc.Client = mqtt.NewClient(o)
 	ret := mqc.Connect()
 	ret.Wait()
-	return mqc, ret.Error()
+	if err := ret.Error(); err != nil {
+		mqc.closeBridge()
+		return mqc, err
+	}
+	unsent.resend(mqc.Client)
+	return mqc, nil
 }
 
-func newMqttAuthClient(username, password, systemkey, systemsecret string, timeout int, address string, ssl *tls.Config) (MqttClient, error) {
+func newMqttAuthClient(username, password, systemkey, systemsecret string, timeout int, address string, ssl *tls.Config, conn *mqttConnectOptions) (MqttClient, error) {
 	o := mqtt.NewClientOptions()
 	o.SetAutoReconnect(false)
 	o.SetConnectionLostHandler(nil)
-	if ssl != nil {
-		o.AddBroker("tls://" + address)
-		o.SetTLSConfig(ssl)
-	} else {
-		o.AddBroker("tcp://" + address)
-	}
 	clientid := username + ":" + password
+	bridge, _, err := conn.apply(o, address, ssl, clientid, true)
+	if err != nil {
+		return nil, err
+	}
 	o.SetClientID(clientid)
 	o.SetUsername(systemkey)
 	o.SetPassword(systemsecret)
 	o.SetConnectTimeout(time.Duration(timeout) * time.Second)
-	cli := mqtt.NewClient(o)
-	mqc := &mqttBaseClient{cli, address, "", systemkey, systemsecret, clientid, timeout}
+	mqc := newMqttBaseClient(address, "", systemkey, systemsecret, clientid, timeout)
+	mqc.bridge = bridge
+	mqc.Client = mqtt.NewClient(o)
 	ret := mqc.Connect()
 	ret.Wait()
-	return mqc, ret.Error()
+	if err := ret.Error(); err != nil {
+		mqc.closeBridge()
+		return mqc, err
+	}
+	return mqc, nil
 }
 
 func publish(c MqttClient, topic string, data []byte, qos int, mid uint16) error {
@@ -365,16 +453,34 @@ func publish(c MqttClient, topic string, data []byte, qos int, mid uint16) error
 }
 
 func subscribe(c MqttClient, topic string, qos int) (<-chan *mqttTypes.Publish, error) {
-	if c == nil {
-		return nil, errors.New("MQTTClient is uninitialized")
+	sub, err := subscribeWithOptions(c, topic, qos, SubscribeOptions{}, nil)
+	if err != nil {
+		return nil, err
 	}
-	pubs := make(chan *mqttTypes.Publish, 50)
-	ret := c.Subscribe(topic, uint8(qos), func(client mqtt.Client, msg mqtt.Message) {
-		path, _ := mqttTypes.NewTopicPath(msg.Topic())
-		pubs <- &mqttTypes.Publish{Topic: path, Payload: msg.Payload()}
-	})
-	ret.WaitTimeout(1 * time.Second)
-	return pubs, ret.Error()
+	return sub.Messages(), nil
+}
+
+//publishHttp posts a message to the platform, which publishes it to the broker like any other message.
+//The body travels as a json string, so payloads that are not valid utf-8 are refused rather than altered.
+//The user and device clients publish over http with it, DevClient.PublishHttp keeps its own older behaviour.
+func publishHttp(c cbClient, systemKey, topic string, message []byte, qos int) error {
+	if !utf8.Valid(message) {
+		return fmt.Errorf("Cannot publish to '%s' over http: payload is not valid utf-8", topic)
+	}
+	creds, err := c.credentials()
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"topic": topic,
+		"body":  string(message),
+		"qos":   qos,
+	}
+	_, err = mapResponse(post(c, PUBLISH_HTTP_PREAMBLE+systemKey+"/publish", data, creds, nil))
+	if err != nil {
+		return fmt.Errorf("Error publishing over http: %v", err)
+	}
+	return nil
 }
 
 func unsubscribe(c MqttClient, topic string) error {
@@ -383,7 +489,11 @@ func unsubscribe(c MqttClient, topic string) error {
 	}
 	ret := c.Unsubscribe(topic)
 	ret.WaitTimeout(1 * time.Second)
-	return ret.Error()
+	if err := ret.Error(); err != nil {
+		return err
+	}
+	subscriptionsFor(c).remove(topic)
+	return nil
 }
 
 func disconnect(c MqttClient) error {
@@ -391,6 +501,7 @@ func disconnect(c MqttClient) error {
 		return errors.New("MQTTClient is uninitialized")
 	}
 	c.Disconnect(250)
+	forgetSubscriptions(c)
 	return nil
 }
 
@@ -407,7 +518,7 @@ func getMqttTopicsWithQuery(c cbClient, systemKey string, columns []string, page
 		Order: []Ordering{
 			Ordering{
 				SortOrder: descending,
-				OrderKey:  "topicid",
+				OrderKey:  _TOPIC_COLUMN_TOPIC,
 			},
 		},
 	}
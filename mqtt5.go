@@ -0,0 +1,561 @@
+package GoSDK
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"golang.org/x/net/websocket"
+)
+
+//Reason codes for Mqtt5Client.Disconnect
+const (
+	MQTT5NormalDisconnection = 0x00
+	//MQTT5DisconnectWithWill has the broker publish the last will
+	MQTT5DisconnectWithWill = 0x04
+)
+
+//reason codes from the broker at or above this are failures
+const _MQTT5_FAILURE_REASON_CODE = 0x80
+
+const _MQTT5_DEFAULT_KEEPALIVE = 60 * time.Second
+
+//Mqtt5Property is a user property, an application defined key and value. A key can appear more than once.
+type Mqtt5Property struct {
+	Key   string
+	Value string
+}
+
+//Mqtt5Message is a message published or received over MQTT 5
+type Mqtt5Message struct {
+	Topic   string
+	Payload []byte
+	Qos     int
+	Retain  bool
+	//UserProperties are carried with the message to its subscribers
+	UserProperties []Mqtt5Property
+	//ResponseTopic and CorrelationData let the receiver of a request address its response
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+	//Expiry is how long the broker keeps the message for subscribers that haven't received it yet, rounded
+	//up to a second. Zero never expires. On a received message it is the time that was left.
+	Expiry time.Duration
+	//TopicAlias, when not zero, stands for Topic on the connection. After the first publish with an alias,
+	//later publishes with the same alias and topic send the alias alone. It must not exceed the broker's
+	//TopicAliasMaximum. On a received message it is the alias the broker used, if any; Topic is always set.
+	TopicAlias uint16
+}
+
+//Mqtt5Handler is called for each message received on a subscription, one at a time in the order they
+//arrive. Qos 1 and 2 messages are acknowledged to the broker once the handler returns.
+type Mqtt5Handler func(msg *Mqtt5Message)
+
+//Mqtt5Options configures an MQTT 5 connection
+type Mqtt5Options struct {
+	//KeepAlive defaults to 60 seconds
+	KeepAlive time.Duration
+	//CleanStart discards any session the broker kept for the client id
+	CleanStart bool
+	//SessionExpiry is how long the broker keeps the session after the connection ends.
+	//Zero ends the session with the connection.
+	SessionExpiry time.Duration
+	//TopicAliasMaximum is the highest topic alias the broker may use when sending to the client. Zero allows none.
+	TopicAliasMaximum uint16
+	UserProperties    []Mqtt5Property
+	LastWill          *LastWillPacket
+	//OnDisconnect is called once when the connection ends without Disconnect being called.
+	//The error is a *Mqtt5ReasonError when the broker closed the connection with a reason code.
+	OnDisconnect func(err error)
+}
+
+//Mqtt5Connack is the broker's answer to the connect
+type Mqtt5Connack struct {
+	ReasonCode     byte
+	SessionPresent bool
+	//AssignedClientID is set when the client connected with an empty client id
+	AssignedClientID string
+	//TopicAliasMaximum is the highest topic alias the client may publish with
+	TopicAliasMaximum uint16
+	MaximumQos        int
+	RetainAvailable   bool
+	ReasonString      string
+	UserProperties    []Mqtt5Property
+}
+
+//Mqtt5Ack is the broker's answer to a qos 1 or 2 publish
+type Mqtt5Ack struct {
+	ReasonCode     byte
+	ReasonString   string
+	UserProperties []Mqtt5Property
+}
+
+//Mqtt5ReasonError is returned when the broker answers with a failure reason code, 0x80 or above
+type Mqtt5ReasonError struct {
+	Op     string
+	Code   byte
+	Reason string
+}
+
+func (e *Mqtt5ReasonError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s failed with reason code 0x%02X", e.Op, e.Code)
+	}
+	return fmt.Sprintf("%s failed with reason code 0x%02X: %s", e.Op, e.Code, e.Reason)
+}
+
+//Mqtt5Client is a connection to the broker over MQTT 5. It is separate from MqttClient, whose mqtt library
+//only speaks 3.1 and 3.1.1. It does not reconnect on its own: once Done is closed, connect again.
+type Mqtt5Client interface {
+	//Publish sends msg and, for qos 1 and 2, waits for the broker's answer. The ack is nil for qos 0.
+	Publish(msg *Mqtt5Message) (*Mqtt5Ack, error)
+	Subscribe(filter string, qos int, handler Mqtt5Handler) error
+	Unsubscribe(filters ...string) error
+	//Disconnect closes the connection, telling the broker why with a reason code such as MQTT5NormalDisconnection
+	Disconnect(reason byte) error
+	Connack() *Mqtt5Connack
+	//Done is closed when the connection ends
+	Done() <-chan struct{}
+	//Err returns why the connection ended, or nil after Disconnect
+	Err() error
+}
+
+//InitializeMQTT5 connects to the broker over MQTT 5. The connection is independent of MQTTClient.
+//An empty clientid has the broker assign one, see Mqtt5Connack.AssignedClientID.
+func (u *UserClient) InitializeMQTT5(clientid string, timeout int, ssl *tls.Config, opts *Mqtt5Options) (Mqtt5Client, error) {
+	return newMqtt5Client(u.UserToken, u.SystemKey, clientid, timeout, u.MqttAddr, ssl, u.webSocket, opts)
+}
+
+//InitializeMQTT5 connects to the broker over MQTT 5. The connection is independent of MQTTClient.
+//An empty clientid has the broker assign one, see Mqtt5Connack.AssignedClientID.
+func (d *DeviceClient) InitializeMQTT5(clientid string, timeout int, ssl *tls.Config, opts *Mqtt5Options) (Mqtt5Client, error) {
+	return newMqtt5Client(d.DeviceToken, d.SystemKey, clientid, timeout, d.MqttAddr, ssl, d.webSocket, opts)
+}
+
+//InitializeMQTT5 connects to the broker over MQTT 5. The connection is independent of MQTTClient.
+//An empty clientid has the broker assign one, see Mqtt5Connack.AssignedClientID.
+func (d *DevClient) InitializeMQTT5(clientid, systemkey string, timeout int, ssl *tls.Config, opts *Mqtt5Options) (Mqtt5Client, error) {
+	return newMqtt5Client(d.DevToken, systemkey, clientid, timeout, d.MqttAddr, ssl, d.webSocket, opts)
+}
+
+type mqtt5Client struct {
+	client  *paho.Client
+	router  *mqtt5Router
+	connack *Mqtt5Connack
+	//aliasLock is held across publishes with a topic alias, so that the broker sees them in the
+	//order the aliases map records them
+	aliasLock    sync.Mutex
+	aliases      map[uint16]string
+	lock         sync.Mutex
+	err          error
+	done         chan struct{}
+	doneOnce     sync.Once
+	onDisconnect func(err error)
+}
+
+func newMqtt5Client(token, systemkey, clientid string, timeout int, address string, ssl *tls.Config, ws *WebSocketOptions, opts *Mqtt5Options) (*mqtt5Client, error) {
+	if opts == nil {
+		opts = &Mqtt5Options{}
+	}
+	u, err := brokerURL(address, ssl, ws, false)
+	if err != nil {
+		return nil, err
+	}
+	wait := time.Duration(timeout) * time.Second
+	conn, err := dialBroker(u, ssl, ws, wait)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to broker: %v", err)
+	}
+	m := &mqtt5Client{
+		router:       newMqtt5Router(),
+		aliases:      map[uint16]string{},
+		done:         make(chan struct{}),
+		onDisconnect: opts.OnDisconnect,
+	}
+	m.client = paho.NewClient(paho.ClientConfig{
+		ClientID:      clientid,
+		Conn:          conn,
+		Router:        m.router,
+		PacketTimeout: wait,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			reason := ""
+			if d.Properties != nil {
+				reason = d.Properties.ReasonString
+			}
+			m.finish(&Mqtt5ReasonError{Op: "Connection", Code: d.ReasonCode, Reason: reason}, true)
+		},
+		OnClientError: func(err error) {
+			m.finish(err, true)
+		},
+	})
+	ca, err := m.client.Connect(context.Background(), mqtt5ConnectPacket(token, systemkey, clientid, opts))
+	if ca != nil && ca.ReasonCode >= _MQTT5_FAILURE_REASON_CODE {
+		reason := ""
+		if ca.Properties != nil {
+			reason = ca.Properties.ReasonString
+		}
+		return nil, &Mqtt5ReasonError{Op: "Connect", Code: ca.ReasonCode, Reason: reason}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to broker: %v", err)
+	}
+	m.connack = connackFromPaho(ca)
+	return m, nil
+}
+
+func mqtt5ConnectPacket(token, systemkey, clientid string, opts *Mqtt5Options) *paho.Connect {
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = _MQTT5_DEFAULT_KEEPALIVE
+	}
+	sessionExpiry := uint32(opts.SessionExpiry / time.Second)
+	aliasMax := opts.TopicAliasMaximum
+	cp := &paho.Connect{
+		ClientID:     clientid,
+		Username:     token,
+		UsernameFlag: true,
+		Password:     []byte(systemkey),
+		PasswordFlag: true,
+		KeepAlive:    uint16(keepAlive / time.Second),
+		CleanStart:   opts.CleanStart,
+		Properties: &paho.ConnectProperties{
+			SessionExpiryInterval: &sessionExpiry,
+			TopicAliasMaximum:     &aliasMax,
+			User:                  toPahoUser(opts.UserProperties),
+		},
+	}
+	if will := opts.LastWill; will != nil {
+		cp.WillMessage = &paho.WillMessage{
+			Topic:   will.Topic,
+			Payload: []byte(will.Body),
+			QoS:     byte(will.Qos),
+			Retain:  will.Retain,
+		}
+	}
+	return cp
+}
+
+//dialBroker opens the network connection to the broker at u. Unlike the MqttClient connection,
+//websockets are dialed here directly, so custom headers need no bridge.
+func dialBroker(u *url.URL, ssl *tls.Config, ws *WebSocketOptions, timeout time.Duration) (net.Conn, error) {
+	switch u.Scheme {
+	case "tcp":
+		return net.DialTimeout("tcp", u.Host, timeout)
+	case "tls", "ssl", "tcps":
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", u.Host, ssl)
+	case "ws", "wss":
+		var header http.Header
+		if ws != nil {
+			header = ws.Header
+		}
+		config, err := webSocketConfig(u, ssl, header)
+		if err != nil {
+			return nil, err
+		}
+		config.Dialer = &net.Dialer{Timeout: timeout}
+		conn, err := websocket.DialConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		conn.PayloadType = websocket.BinaryFrame
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("Unsupported broker scheme '%s'", u.Scheme)
+	}
+}
+
+func (m *mqtt5Client) Publish(msg *Mqtt5Message) (*Mqtt5Ack, error) {
+	if err := ValidateTopicName(msg.Topic); err != nil {
+		return nil, err
+	}
+	if msg.Qos < 0 || msg.Qos > 2 {
+		return nil, fmt.Errorf("Invalid qos %d", msg.Qos)
+	}
+	pub := &paho.Publish{
+		QoS:     byte(msg.Qos),
+		Retain:  msg.Retain,
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   msg.ResponseTopic,
+			CorrelationData: msg.CorrelationData,
+			ContentType:     msg.ContentType,
+			User:            toPahoUser(msg.UserProperties),
+		},
+	}
+	if msg.Expiry > 0 {
+		expiry := uint32((msg.Expiry + time.Second - 1) / time.Second)
+		pub.Properties.MessageExpiry = &expiry
+	}
+	if alias := msg.TopicAlias; alias != 0 {
+		if alias > m.connack.TopicAliasMaximum {
+			return nil, fmt.Errorf("Topic alias %d is over the broker's maximum of %d", alias, m.connack.TopicAliasMaximum)
+		}
+		pub.Properties.TopicAlias = &alias
+		m.aliasLock.Lock()
+		defer m.aliasLock.Unlock()
+		if m.aliases[alias] == msg.Topic {
+			pub.Topic = ""
+		}
+	}
+	resp, err := m.client.Publish(context.Background(), pub)
+	if resp != nil && resp.ReasonCode >= _MQTT5_FAILURE_REASON_CODE {
+		ack := ackFromPaho(resp)
+		return ack, &Mqtt5ReasonError{Op: "Publish", Code: ack.ReasonCode, Reason: ack.ReasonString}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error publishing to '%s': %v", msg.Topic, err)
+	}
+	if msg.TopicAlias != 0 {
+		m.aliases[msg.TopicAlias] = msg.Topic
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	return ackFromPaho(resp), nil
+}
+
+func (m *mqtt5Client) Subscribe(filter string, qos int, handler Mqtt5Handler) error {
+	if err := ValidateTopicFilter(filter); err != nil {
+		return err
+	}
+	if handler == nil {
+		return fmt.Errorf("A handler is required")
+	}
+	//registered first, since messages can arrive before the suback
+	m.router.add(filter, handler)
+	sa, err := m.client.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{filter: {QoS: byte(qos)}},
+	})
+	if sa != nil && len(sa.Reasons) > 0 && sa.Reasons[0] >= _MQTT5_FAILURE_REASON_CODE {
+		m.router.remove(filter)
+		reason := ""
+		if sa.Properties != nil {
+			reason = sa.Properties.ReasonString
+		}
+		return &Mqtt5ReasonError{Op: "Subscribe to '" + filter + "'", Code: sa.Reasons[0], Reason: reason}
+	}
+	if err != nil {
+		m.router.remove(filter)
+		return fmt.Errorf("Error subscribing to '%s': %v", filter, err)
+	}
+	return nil
+}
+
+func (m *mqtt5Client) Unsubscribe(filters ...string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+	ua, err := m.client.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: filters})
+	for i, filter := range filters {
+		if ua == nil || i >= len(ua.Reasons) || ua.Reasons[i] < _MQTT5_FAILURE_REASON_CODE {
+			m.router.remove(filter)
+		}
+	}
+	if ua != nil {
+		for i, code := range ua.Reasons {
+			if code >= _MQTT5_FAILURE_REASON_CODE && i < len(filters) {
+				reason := ""
+				if ua.Properties != nil {
+					reason = ua.Properties.ReasonString
+				}
+				return &Mqtt5ReasonError{Op: "Unsubscribe from '" + filters[i] + "'", Code: code, Reason: reason}
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error unsubscribing: %v", err)
+	}
+	return nil
+}
+
+func (m *mqtt5Client) Disconnect(reason byte) error {
+	//finished first, so that errors from the connection closing under the library's goroutines are not reported
+	m.finish(nil, false)
+	return m.client.Disconnect(&paho.Disconnect{ReasonCode: reason})
+}
+
+func (m *mqtt5Client) Connack() *Mqtt5Connack {
+	return m.connack
+}
+
+func (m *mqtt5Client) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *mqtt5Client) Err() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+//finish records why the connection ended, the first time it is called
+func (m *mqtt5Client) finish(err error, notify bool) {
+	m.doneOnce.Do(func() {
+		m.lock.Lock()
+		m.err = err
+		m.lock.Unlock()
+		close(m.done)
+		if notify && m.onDisconnect != nil {
+			m.onDisconnect(err)
+		}
+	})
+}
+
+//mqtt5Router hands received messages to the handlers of the subscriptions they match, resolving the
+//topic aliases the broker uses
+type mqtt5Router struct {
+	lock     sync.Mutex
+	handlers map[string]Mqtt5Handler
+	aliases  map[uint16]string
+}
+
+func newMqtt5Router() *mqtt5Router {
+	return &mqtt5Router{
+		handlers: map[string]Mqtt5Handler{},
+		aliases:  map[uint16]string{},
+	}
+}
+
+func (r *mqtt5Router) add(filter string, handler Mqtt5Handler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers[filter] = handler
+}
+
+func (r *mqtt5Router) remove(filter string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kept := make(map[string]Mqtt5Handler, len(r.handlers))
+	for f, h := range r.handlers {
+		if f != filter {
+			kept[f] = h
+		}
+	}
+	r.handlers = kept
+}
+
+//RegisterHandler is part of paho.Router. Handlers are added with add instead.
+func (r *mqtt5Router) RegisterHandler(filter string, h paho.MessageHandler) {}
+
+//UnregisterHandler is part of paho.Router
+func (r *mqtt5Router) UnregisterHandler(filter string) {
+	r.remove(filter)
+}
+
+//SetDebugLogger is part of paho.Router
+func (r *mqtt5Router) SetDebugLogger(l paho.Logger) {}
+
+//Route is called by the mqtt library for each message received, in order
+func (r *mqtt5Router) Route(pb *packets5.Publish) {
+	pub := paho.PublishFromPacketPublish(pb)
+	msg := &Mqtt5Message{
+		Topic:   pub.Topic,
+		Payload: pub.Payload,
+		Qos:     int(pub.QoS),
+		Retain:  pub.Retain,
+	}
+	if props := pub.Properties; props != nil {
+		msg.UserProperties = fromPahoUser(props.User)
+		msg.ResponseTopic = props.ResponseTopic
+		msg.CorrelationData = props.CorrelationData
+		msg.ContentType = props.ContentType
+		if props.MessageExpiry != nil {
+			msg.Expiry = time.Duration(*props.MessageExpiry) * time.Second
+		}
+		if props.TopicAlias != nil {
+			msg.TopicAlias = *props.TopicAlias
+		}
+	}
+	r.lock.Lock()
+	if msg.TopicAlias != 0 {
+		if msg.Topic != "" {
+			r.aliases[msg.TopicAlias] = msg.Topic
+		} else {
+			msg.Topic = r.aliases[msg.TopicAlias]
+		}
+	}
+	var matched []Mqtt5Handler
+	for filter, h := range r.handlers {
+		if TopicMatches(unsharedFilter(filter), msg.Topic) {
+			matched = append(matched, h)
+		}
+	}
+	r.lock.Unlock()
+	for _, h := range matched {
+		h(msg)
+	}
+}
+
+//unsharedFilter strips the $share/<group>/ prefix of a shared subscription
+func unsharedFilter(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return filter
+	}
+	return parts[2]
+}
+
+func connackFromPaho(ca *paho.Connack) *Mqtt5Connack {
+	rval := &Mqtt5Connack{
+		ReasonCode:      ca.ReasonCode,
+		SessionPresent:  ca.SessionPresent,
+		MaximumQos:      2,
+		RetainAvailable: true,
+	}
+	if props := ca.Properties; props != nil {
+		rval.AssignedClientID = props.AssignedClientID
+		rval.ReasonString = props.ReasonString
+		rval.UserProperties = fromPahoUser(props.User)
+		rval.RetainAvailable = props.RetainAvailable
+		if props.TopicAliasMaximum != nil {
+			rval.TopicAliasMaximum = *props.TopicAliasMaximum
+		}
+		if props.MaximumQoS != nil {
+			rval.MaximumQos = int(*props.MaximumQoS)
+		}
+	}
+	return rval
+}
+
+func ackFromPaho(resp *paho.PublishResponse) *Mqtt5Ack {
+	ack := &Mqtt5Ack{ReasonCode: resp.ReasonCode}
+	if resp.Properties != nil {
+		ack.ReasonString = resp.Properties.ReasonString
+		ack.UserProperties = fromPahoUser(resp.Properties.User)
+	}
+	return ack
+}
+
+func toPahoUser(props []Mqtt5Property) paho.UserProperties {
+	if len(props) == 0 {
+		return nil
+	}
+	rval := make(paho.UserProperties, 0, len(props))
+	for _, p := range props {
+		rval = append(rval, paho.UserProperty{Key: p.Key, Value: p.Value})
+	}
+	return rval
+}
+
+func fromPahoUser(props paho.UserProperties) []Mqtt5Property {
+	if len(props) == 0 {
+		return nil
+	}
+	rval := make([]Mqtt5Property, 0, len(props))
+	for _, p := range props {
+		rval = append(rval, Mqtt5Property{Key: p.Key, Value: p.Value})
+	}
+	return rval
+}
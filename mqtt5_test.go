@@ -0,0 +1,319 @@
+package GoSDK
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+)
+
+//fakeMqtt5Broker accepts one MQTT 5 connection, answers it with connack and acks publishes and subscribes
+//with the reason codes in refuse. Every packet the client sends is passed on to packets. Like a real broker
+//it closes the connection after the client's disconnect.
+type fakeMqtt5Broker struct {
+	ln      net.Listener
+	connack *packets5.Connack
+	refuse  map[string]byte
+	packets chan *packets5.ControlPacket
+	lock    sync.Mutex
+	conn    net.Conn
+}
+
+func newFakeMqtt5Broker(t *testing.T, connack *packets5.Connack, refuse map[string]byte) *fakeMqtt5Broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connack.Properties == nil {
+		connack.Properties = &packets5.Properties{}
+	}
+	b := &fakeMqtt5Broker{ln: ln, connack: connack, refuse: refuse, packets: make(chan *packets5.ControlPacket, 100)}
+	go b.serve()
+	return b
+}
+
+func (b *fakeMqtt5Broker) serve() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	b.lock.Lock()
+	b.conn = conn
+	b.lock.Unlock()
+	for {
+		cp, err := packets5.ReadPacket(conn)
+		if err != nil {
+			close(b.packets)
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets5.Connect:
+			b.send(b.connack)
+		case *packets5.Pingreq:
+			b.send(&packets5.Pingresp{})
+		case *packets5.Publish:
+			if p.QoS == 1 {
+				b.send(&packets5.Puback{PacketID: p.PacketID, ReasonCode: b.refuse[p.Topic], Properties: &packets5.Properties{}})
+			}
+		case *packets5.Subscribe:
+			suback := &packets5.Suback{PacketID: p.PacketID, Properties: &packets5.Properties{}}
+			for filter, opts := range p.Subscriptions {
+				code, refused := b.refuse[filter]
+				if !refused {
+					code = opts.QoS
+				}
+				suback.Reasons = append(suback.Reasons, code)
+			}
+			b.send(suback)
+		case *packets5.Unsubscribe:
+			b.send(&packets5.Unsuback{PacketID: p.PacketID, Reasons: make([]byte, len(p.Topics)), Properties: &packets5.Properties{}})
+		case *packets5.Disconnect:
+			b.packets <- cp
+			conn.Close()
+			continue
+		}
+		b.packets <- cp
+	}
+}
+
+func (b *fakeMqtt5Broker) send(p io.WriterTo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p.WriteTo(b.conn)
+}
+
+//next returns the next packet of type kind the client sent
+func (b *fakeMqtt5Broker) next(t *testing.T, kind byte) *packets5.ControlPacket {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case cp, ok := <-b.packets:
+			if !ok {
+				t.Fatalf("connection closed waiting for packet type %d", kind)
+			}
+			if cp.Type == kind {
+				return cp
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for packet type %d", kind)
+		}
+	}
+}
+
+func (b *fakeMqtt5Broker) close() {
+	b.ln.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+//connectFakeMqtt5 connects with a short keep alive. The mqtt library's pinger, when stopped before it started,
+//goes on to its first tick, a quarter of the keep alive, holding up the close and then failing to write. Tests
+//that check how the connection ends wait for the first ping.
+func connectFakeMqtt5(t *testing.T, b *fakeMqtt5Broker, clientid string, opts *Mqtt5Options) (Mqtt5Client, error) {
+	if opts == nil {
+		opts = &Mqtt5Options{}
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = time.Second
+	}
+	u := NewUserClientWithServiceAccountAndAddrs("", b.ln.Addr().String(), "key", "secret", "user@example.com", "token")
+	return u.InitializeMQTT5(clientid, 2, nil, opts)
+}
+
+func TestMqtt5Connect(t *testing.T) {
+	aliasMax := uint16(5)
+	b := newFakeMqtt5Broker(t, &packets5.Connack{Properties: &packets5.Properties{AssignedClientID: "assigned", TopicAliasMaximum: &aliasMax}}, nil)
+	defer b.close()
+	disconnected := make(chan error, 1)
+	c, err := connectFakeMqtt5(t, b, "", &Mqtt5Options{KeepAlive: time.Second, SessionExpiry: time.Minute, OnDisconnect: func(err error) { disconnected <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := b.next(t, packets5.CONNECT).Content.(*packets5.Connect)
+	if connect.Username != "token" || string(connect.Password) != "key" || connect.ClientID != "" {
+		t.Errorf("connected with %q, %q, client id %q", connect.Username, connect.Password, connect.ClientID)
+	}
+	if connect.KeepAlive != 1 {
+		t.Errorf("keep alive %d", connect.KeepAlive)
+	}
+	if connect.Properties.SessionExpiryInterval == nil || *connect.Properties.SessionExpiryInterval != 60 {
+		t.Errorf("session expiry %v", connect.Properties.SessionExpiryInterval)
+	}
+	if ca := c.Connack(); ca.AssignedClientID != "assigned" || ca.TopicAliasMaximum != 5 {
+		t.Errorf("got connack %+v", ca)
+	}
+
+	b.next(t, packets5.PINGREQ)
+	if err := c.Disconnect(MQTT5NormalDisconnection); err != nil {
+		t.Fatal(err)
+	}
+	b.next(t, packets5.DISCONNECT)
+	select {
+	case <-c.Done():
+	default:
+		t.Error("Done is not closed after Disconnect")
+	}
+	if c.Err() != nil {
+		t.Errorf("got %v after Disconnect", c.Err())
+	}
+	select {
+	case err := <-disconnected:
+		t.Errorf("OnDisconnect called after Disconnect with %v", err)
+	default:
+	}
+}
+
+func TestMqtt5ConnectRefused(t *testing.T) {
+	b := newFakeMqtt5Broker(t, &packets5.Connack{ReasonCode: 0x86, Properties: &packets5.Properties{ReasonString: "bad token"}}, nil)
+	defer b.close()
+	_, err := connectFakeMqtt5(t, b, "cid", nil)
+	if rerr, ok := err.(*Mqtt5ReasonError); !ok || rerr.Code != 0x86 || rerr.Reason != "bad token" {
+		t.Errorf("got %v, want the connack's reason", err)
+	}
+}
+
+func TestMqtt5ServerDisconnect(t *testing.T) {
+	b := newFakeMqtt5Broker(t, &packets5.Connack{}, nil)
+	defer b.close()
+	disconnected := make(chan error, 1)
+	c, err := connectFakeMqtt5(t, b, "cid", &Mqtt5Options{OnDisconnect: func(err error) { disconnected <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.next(t, packets5.PINGREQ)
+	b.send(&packets5.Disconnect{ReasonCode: 0x8B, Properties: &packets5.Properties{ReasonString: "shutting down"}})
+	select {
+	case err := <-disconnected:
+		if rerr, ok := err.(*Mqtt5ReasonError); !ok || rerr.Code != 0x8B {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect was not called")
+	}
+	<-c.Done()
+	if _, ok := c.Err().(*Mqtt5ReasonError); !ok {
+		t.Errorf("Err returned %v", c.Err())
+	}
+}
+
+func TestMqtt5Publish(t *testing.T) {
+	aliasMax := uint16(5)
+	b := newFakeMqtt5Broker(t, &packets5.Connack{Properties: &packets5.Properties{TopicAliasMaximum: &aliasMax}}, map[string]byte{"denied": 0x87})
+	defer b.close()
+	c, err := connectFakeMqtt5(t, b, "cid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(MQTT5NormalDisconnection)
+
+	ack, err := c.Publish(&Mqtt5Message{
+		Topic:          "a/b",
+		Payload:        []byte("x"),
+		Qos:            1,
+		UserProperties: []Mqtt5Property{{Key: "k", Value: "v"}},
+		ResponseTopic:  "replies/1",
+		Expiry:         1500 * time.Millisecond,
+	})
+	if err != nil || ack == nil || ack.ReasonCode != 0 {
+		t.Fatalf("got %+v, %v", ack, err)
+	}
+	pub := b.next(t, packets5.PUBLISH).Content.(*packets5.Publish)
+	if pub.Topic != "a/b" || string(pub.Payload) != "x" || pub.QoS != 1 || pub.Properties.ResponseTopic != "replies/1" {
+		t.Errorf("broker got %+v", pub)
+	}
+	if len(pub.Properties.User) != 1 || pub.Properties.User[0].Key != "k" || pub.Properties.User[0].Value != "v" {
+		t.Errorf("user properties %v", pub.Properties.User)
+	}
+	if pub.Properties.MessageExpiry == nil || *pub.Properties.MessageExpiry != 2 {
+		t.Errorf("expiry %v, want rounded up to 2 seconds", pub.Properties.MessageExpiry)
+	}
+
+	_, err = c.Publish(&Mqtt5Message{Topic: "denied", Qos: 1})
+	if rerr, ok := err.(*Mqtt5ReasonError); !ok || rerr.Code != 0x87 {
+		t.Errorf("got %v, want the puback's reason", err)
+	}
+	b.next(t, packets5.PUBLISH)
+
+	//the topic goes with the first publish on an alias only
+	for _, want := range []string{"a/c", ""} {
+		if _, err := c.Publish(&Mqtt5Message{Topic: "a/c", TopicAlias: 1}); err != nil {
+			t.Fatal(err)
+		}
+		pub := b.next(t, packets5.PUBLISH).Content.(*packets5.Publish)
+		if pub.Topic != want || pub.Properties.TopicAlias == nil || *pub.Properties.TopicAlias != 1 {
+			t.Errorf("got topic %q alias %v, want %q", pub.Topic, pub.Properties.TopicAlias, want)
+		}
+	}
+	if _, err := c.Publish(&Mqtt5Message{Topic: "a/c", TopicAlias: 6}); err == nil {
+		t.Error("expected an alias over the broker's maximum to be refused")
+	}
+	if _, err := c.Publish(&Mqtt5Message{Topic: "a/+"}); err == nil {
+		t.Error("expected a wildcard topic to be refused")
+	}
+}
+
+func TestMqtt5Subscribe(t *testing.T) {
+	b := newFakeMqtt5Broker(t, &packets5.Connack{}, map[string]byte{"denied/#": 0x87})
+	defer b.close()
+	c, err := connectFakeMqtt5(t, b, "cid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect(MQTT5NormalDisconnection)
+
+	received := make(chan *Mqtt5Message, 1)
+	release := make(chan struct{})
+	if err := c.Subscribe("a/+", 1, func(msg *Mqtt5Message) {
+		received <- msg
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sub := b.next(t, packets5.SUBSCRIBE).Content.(*packets5.Subscribe)
+	if opts, ok := sub.Subscriptions["a/+"]; !ok || opts.QoS != 1 {
+		t.Errorf("broker got %+v", sub.Subscriptions)
+	}
+
+	b.send(&packets5.Publish{Topic: "a/b", Payload: []byte("y"), QoS: 1, PacketID: 7, Properties: &packets5.Properties{User: []packets5.User{{Key: "k", Value: "v"}}}})
+	select {
+	case msg := <-received:
+		if msg.Topic != "a/b" || string(msg.Payload) != "y" || msg.Qos != 1 || len(msg.UserProperties) != 1 {
+			t.Errorf("handler got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler was not called")
+	}
+	//the ack waits for the handler
+	wait := time.After(100 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case cp := <-b.packets:
+			if cp.Type != packets5.PINGREQ {
+				t.Fatalf("got packet type %d before the handler returned", cp.Type)
+			}
+		case <-wait:
+			waiting = false
+		}
+	}
+	close(release)
+	if ack := b.next(t, packets5.PUBACK).Content.(*packets5.Puback); ack.PacketID != 7 {
+		t.Errorf("acked packet %d, want 7", ack.PacketID)
+	}
+
+	err = c.Subscribe("denied/#", 0, func(*Mqtt5Message) {})
+	if rerr, ok := err.(*Mqtt5ReasonError); !ok || rerr.Code != 0x87 {
+		t.Errorf("got %v, want the suback's reason", err)
+	}
+	if err := c.Subscribe("a/#/b", 0, func(*Mqtt5Message) {}); err == nil {
+		t.Error("expected an invalid filter to be refused")
+	}
+	if err := c.Unsubscribe("a/+"); err != nil {
+		t.Fatal(err)
+	}
+}
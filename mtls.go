@@ -0,0 +1,194 @@
+package GoSDK
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const _DEVICE_MTLS_AUTH = "mtls/auth"
+
+//ClientCertificate is an X.509 client certificate and key loaded from PEM files. It can be reloaded
+//while in use: connections made after a reload present the new certificate.
+type ClientCertificate struct {
+	CertFile string
+	KeyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+//LoadClientCertificate reads a PEM encoded certificate and private key
+func LoadClientCertificate(certFile, keyFile string) (*ClientCertificate, error) {
+	c := &ClientCertificate{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Reload reads the certificate and key files again. The current certificate is kept if they can't be loaded.
+func (c *ClientCertificate) Reload() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading client certificate: %v", err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	return nil
+}
+
+//Watch checks the files every interval and reloads them when they change. Failed reloads are passed to onError, which may be nil.
+//Call the returned function to stop watching.
+func (c *ClientCertificate) Watch(interval time.Duration, onError func(error)) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !c.changed() {
+					continue
+				}
+				if err := c.Reload(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+//Certificate returns the certificate currently in use
+func (c *ClientCertificate) Certificate() *tls.Certificate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert
+}
+
+//TLSConfig returns a copy of base that presents the certificate. If base is nil it starts from an empty config,
+//which verifies the server's certificate against the system roots.
+//The certificate is looked up on every handshake, so the config picks up reloads.
+func (c *ClientCertificate) TLSConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	conf := base.Clone()
+	conf.Certificates = nil
+	conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return c.Certificate(), nil
+	}
+	return conf
+}
+
+func (c *ClientCertificate) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Error loading client certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Error loading client certificate: %v", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (c *ClientCertificate) changed() bool {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)
+}
+
+func (b *client) httpTransport() *http.Transport {
+	if b.transport != nil {
+		return b.transport
+	}
+	return tr
+}
+
+//UseClientCertificate makes the device present cert on every https request, and on mqtt connections made with ClientTLSConfig.
+//base is the tls config to start from, nil verifies the server against the system roots.
+func (d *DeviceClient) UseClientCertificate(cert *ClientCertificate, base *tls.Config) {
+	d.clientCert = cert
+	d.clientTLS = cert.TLSConfig(base)
+	d.transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: d.clientTLS,
+	}
+}
+
+//ClientTLSConfig returns the tls config that presents the device's client certificate, to pass to InitializeMQTT.
+//It is nil until UseClientCertificate is called.
+func (d *DeviceClient) ClientTLSConfig() *tls.Config {
+	return d.clientTLS
+}
+
+//AuthenticateDeviceWithCertificate obtains a device token by presenting the client certificate set with UseClientCertificate
+func (d *DeviceClient) AuthenticateDeviceWithCertificate(systemKey, name string) (map[string]interface{}, error) {
+	if d.clientCert == nil {
+		return nil, fmt.Errorf("No client certificate, call UseClientCertificate first")
+	}
+	creds, err := d.credentials()
+	if err != nil {
+		return nil, err
+	}
+	postBody := map[string]interface{}{
+		"system_key": systemKey,
+		"name":       name,
+	}
+	resp, err := post(d, _DEVICE_V4_PREAMBLE+_DEVICE_MTLS_AUTH, postBody, creds, nil)
+	resp, err = mapResponse(resp, err)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := resp.Body.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Got unexpected return value from AuthenticateDeviceWithCertificate: %+v", resp.Body)
+	}
+	token, _ := body["deviceToken"].(string)
+	if token == "" {
+		token, _ = body["device_token"].(string)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("Token not present in response from platform %+v", body)
+	}
+	d.DeviceToken = token
+	return body, nil
+}
+
+//ConnectWithCertificate authenticates with the client certificate and connects to the broker over tls with the new token,
+//replacing the current mqtt client if there is one. Subscriptions made on the replaced client are not carried over.
+func (d *DeviceClient) ConnectWithCertificate(clientid string, timeout int, lastWill *LastWillPacket, callbacks *Callbacks) error {
+	if _, err := d.AuthenticateDeviceWithCertificate(d.SystemKey, d.DeviceName); err != nil {
+		return err
+	}
+	if d.MQTTClient != nil {
+		disconnect(d.MQTTClient)
+		d.MQTTClient = nil
+	}
+	return d.InitializeMQTTWithCallback(clientid, "", timeout, d.clientTLS, lastWill, callbacks)
+}
@@ -0,0 +1,19 @@
+package GoSDK
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestClientCertificateTLSConfigVerifiesServer(t *testing.T) {
+	c := &ClientCertificate{}
+	if c.TLSConfig(nil).InsecureSkipVerify {
+		t.Error("a config built from nil must verify the server certificate")
+	}
+	if !c.TLSConfig(&tls.Config{InsecureSkipVerify: true}).InsecureSkipVerify {
+		t.Error("the base config's settings must be kept")
+	}
+	if c.TLSConfig(nil).GetClientCertificate == nil {
+		t.Error("the config must present the client certificate")
+	}
+}
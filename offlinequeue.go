@@ -0,0 +1,346 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const _OFFLINE_QUEUE_FLUSH_INTERVAL = time.Second
+
+//ErrOfflineQueueFull is returned by Publish when the offline queue is full and its policy rejects new messages
+var ErrOfflineQueueFull = errors.New("Offline publish queue is full")
+
+//EvictionPolicy decides what the offline queue does when a new message would exceed its limits
+type EvictionPolicy int
+
+const (
+	//EvictOldest drops the oldest queued messages to make room
+	EvictOldest EvictionPolicy = iota
+	//RejectNew refuses the new message with ErrOfflineQueueFull
+	RejectNew
+)
+
+//OfflineQueueOptions configures the file-backed queue that holds publishes while the client is offline.
+//Zero limits are unlimited.
+type OfflineQueueOptions struct {
+	//Path is the file the queue is persisted to. It is created if it does not exist.
+	Path        string
+	MaxMessages int
+	MaxBytes    int64
+	MaxAge      time.Duration
+	Eviction    EvictionPolicy
+	//PublishTimeout bounds how long a replayed message waits for the broker. Defaults to 10 seconds.
+	PublishTimeout time.Duration
+	//OnError is called with errors from replaying in the background, such as failing to rewrite the file.
+	//They are ignored if it is nil.
+	OnError func(err error)
+}
+
+type queuedMessage struct {
+	Topic   string    `json:"topic"`
+	Qos     int       `json:"qos"`
+	Payload []byte    `json:"payload"`
+	Queued  time.Time `json:"queued"`
+	//seq orders the messages in memory, so that flush can tell which ones it sent
+	seq uint64
+}
+
+//OfflineQueue persists publishes made while the mqtt client is disconnected, and replays them
+//in order, with their original qos, once it is connected again
+type OfflineQueue struct {
+	lock     sync.Mutex
+	flushing sync.Mutex
+	opts     OfflineQueueOptions
+	journal  *journal
+	msgs     []*queuedMessage
+	size     int64
+	nextSeq  uint64
+	evicted  uint64
+	stop     chan struct{}
+}
+
+//EnableOfflineQueue queues publishes made while the client is offline in a file, replaying them after reconnect.
+//A queue already enabled is closed first, so the same file can be opened again. If opening fails the client is left without a queue.
+func (u *UserClient) EnableOfflineQueue(opts OfflineQueueOptions) error {
+	if err := u.DisableOfflineQueue(); err != nil {
+		return err
+	}
+	q, err := newOfflineQueue(opts, func() MqttClient { return u.MQTTClient })
+	if err != nil {
+		return err
+	}
+	u.offlineQueue = q
+	return nil
+}
+
+//EnableOfflineQueue queues publishes made while the client is offline in a file, replaying them after reconnect.
+//A queue already enabled is closed first, so the same file can be opened again. If opening fails the client is left without a queue.
+func (d *DeviceClient) EnableOfflineQueue(opts OfflineQueueOptions) error {
+	if err := d.DisableOfflineQueue(); err != nil {
+		return err
+	}
+	q, err := newOfflineQueue(opts, func() MqttClient { return d.MQTTClient })
+	if err != nil {
+		return err
+	}
+	d.offlineQueue = q
+	return nil
+}
+
+//DisableOfflineQueue stops queueing publishes. Messages still queued stay in the file for the next EnableOfflineQueue.
+func (u *UserClient) DisableOfflineQueue() error {
+	q := u.offlineQueue
+	u.offlineQueue = nil
+	return q.close()
+}
+
+//DisableOfflineQueue stops queueing publishes. Messages still queued stay in the file for the next EnableOfflineQueue.
+func (d *DeviceClient) DisableOfflineQueue() error {
+	q := d.offlineQueue
+	d.offlineQueue = nil
+	return q.close()
+}
+
+//OfflineQueueLength returns the number of messages waiting to be replayed
+func (u *UserClient) OfflineQueueLength() int {
+	return u.offlineQueue.Len()
+}
+
+//OfflineQueueLength returns the number of messages waiting to be replayed
+func (d *DeviceClient) OfflineQueueLength() int {
+	return d.offlineQueue.Len()
+}
+
+func newOfflineQueue(opts OfflineQueueOptions, current func() MqttClient) (*OfflineQueue, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("Offline queue path is required")
+	}
+	if opts.PublishTimeout <= 0 {
+		opts.PublishTimeout = 10 * time.Second
+	}
+	q := &OfflineQueue{
+		opts: opts,
+		stop: make(chan struct{}),
+	}
+	j, err := openJournal(opts.Path, "offline queue", func(line []byte) error {
+		msg := &queuedMessage{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			return err
+		}
+		q.add(msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.journal = j
+	if err := q.rewrite(); err != nil {
+		return nil, err
+	}
+	go q.run(current)
+	return q, nil
+}
+
+//Len returns the number of queued messages
+func (q *OfflineQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.msgs)
+}
+
+//Evicted returns the number of messages dropped because of the queue's limits
+func (q *OfflineQueue) Evicted() uint64 {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.evicted
+}
+
+//publish sends the message if the client is connected, replaying anything queued first, and queues it otherwise
+func (q *OfflineQueue) publish(c MqttClient, topic string, data []byte, qos int) error {
+	if c != nil && c.IsConnected() {
+		if err := q.flush(c); err != nil {
+			q.fail(err)
+		}
+		if q.Len() == 0 {
+			ret := c.Publish(topic, uint8(qos), false, data)
+			if ret.WaitTimeout(q.opts.PublishTimeout) && ret.Error() == nil {
+				return nil
+			}
+		}
+	}
+	return q.enqueue(&queuedMessage{
+		Topic:   topic,
+		Qos:     qos,
+		Payload: data,
+		Queued:  time.Now(),
+	})
+}
+
+func (q *OfflineQueue) run(current func() MqttClient) {
+	ticker := time.NewTicker(_OFFLINE_QUEUE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c := current(); c != nil && c.IsConnected() && q.Len() > 0 {
+				if err := q.flush(c); err != nil {
+					q.fail(err)
+				}
+			}
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+func (q *OfflineQueue) fail(err error) {
+	if q.opts.OnError != nil {
+		q.opts.OnError(err)
+	}
+}
+
+//flush replays queued messages in order until the queue is empty or a publish fails.
+//The lock isn't held while publishing, so enqueue can evict messages from the front meanwhile;
+//messages are tracked by sequence number rather than position for that reason.
+func (q *OfflineQueue) flush(c MqttClient) error {
+	q.flushing.Lock()
+	defer q.flushing.Unlock()
+	var sent uint64
+	for {
+		q.lock.Lock()
+		if err := q.expire(); err != nil {
+			q.lock.Unlock()
+			return err
+		}
+		var msg *queuedMessage
+		//sequence numbers start at 1 and the queue is in sequence order
+		if i := sort.Search(len(q.msgs), func(i int) bool { return q.msgs[i].seq > sent }); i < len(q.msgs) {
+			msg = q.msgs[i]
+		}
+		q.lock.Unlock()
+		if msg == nil {
+			break
+		}
+		ret := c.Publish(msg.Topic, uint8(msg.Qos), false, msg.Payload)
+		if !ret.WaitTimeout(q.opts.PublishTimeout) || ret.Error() != nil {
+			break
+		}
+		sent = msg.seq
+	}
+	if sent == 0 {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	n := 0
+	for n < len(q.msgs) && q.msgs[n].seq <= sent {
+		n++
+	}
+	q.drop(n)
+	return q.rewrite()
+}
+
+//enqueue appends msg to the queue and its file, enforcing the limits
+func (q *OfflineQueue) enqueue(msg *queuedMessage) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.journal.closed() {
+		return fmt.Errorf("Offline queue is closed")
+	}
+	if err := q.expire(); err != nil {
+		return err
+	}
+	msgSize := int64(len(msg.Payload))
+	if q.opts.MaxBytes > 0 && msgSize > q.opts.MaxBytes {
+		return ErrOfflineQueueFull
+	}
+	over := func() int {
+		n := 0
+		size := q.size
+		for (q.opts.MaxMessages > 0 && len(q.msgs)-n+1 > q.opts.MaxMessages) ||
+			(q.opts.MaxBytes > 0 && size+msgSize > q.opts.MaxBytes) {
+			size -= int64(len(q.msgs[n].Payload))
+			n++
+		}
+		return n
+	}()
+	if over > 0 {
+		if q.opts.Eviction == RejectNew {
+			return ErrOfflineQueueFull
+		}
+		q.drop(over)
+		q.evicted += uint64(over)
+		if err := q.rewrite(); err != nil {
+			return err
+		}
+	}
+	if err := q.journal.append(msg); err != nil {
+		return err
+	}
+	q.add(msg)
+	return nil
+}
+
+//add appends msg to the in-memory queue, the caller must hold the lock
+func (q *OfflineQueue) add(msg *queuedMessage) {
+	q.nextSeq++
+	msg.seq = q.nextSeq
+	q.msgs = append(q.msgs, msg)
+	q.size += int64(len(msg.Payload))
+}
+
+//expire drops messages older than MaxAge, the caller must hold the lock
+func (q *OfflineQueue) expire() error {
+	if q.opts.MaxAge <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-q.opts.MaxAge)
+	n := 0
+	for n < len(q.msgs) && q.msgs[n].Queued.Before(cutoff) {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	q.drop(n)
+	q.evicted += uint64(n)
+	return q.rewrite()
+}
+
+//drop removes the first n messages, the caller must hold the lock
+func (q *OfflineQueue) drop(n int) {
+	if n > len(q.msgs) {
+		n = len(q.msgs)
+	}
+	for _, msg := range q.msgs[:n] {
+		q.size -= int64(len(msg.Payload))
+	}
+	q.msgs = append([]*queuedMessage{}, q.msgs[n:]...)
+}
+
+//rewrite replaces the queue file with the messages still queued, the caller must hold the lock
+func (q *OfflineQueue) rewrite() error {
+	return q.journal.rewrite(len(q.msgs), func(i int) interface{} { return q.msgs[i] })
+}
+
+func (q *OfflineQueue) close() error {
+	if q == nil {
+		return nil
+	}
+	close(q.stop)
+	q.flushing.Lock()
+	defer q.flushing.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.journal.close()
+}
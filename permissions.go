@@ -0,0 +1,338 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+//Where users and devices read the roles they have, with their own token. These endpoints and their response,
+//a list of roles shaped like GetRole's, are assumed rather than documented, and the caller's roles must allow
+//reading roles. DevClient loads anyone's roles through the developer endpoints instead.
+const (
+	_USER_OWN_ROLES_PREAMBLE   = _USER_V4 + "/"
+	_DEVICE_OWN_ROLES_PREAMBLE = _DEVICE_V4_PREAMBLE
+)
+
+//TopicPermission is a topic, or an mqtt topic filter, and the permission level a role grants on it.
+//PERM_READ allows subscribing and PERM_CREATE allows publishing, as set by AddTopicToRole.
+type TopicPermission struct {
+	Topic string
+	Level int
+}
+
+//TopicPermissionError is returned when the caller's roles don't allow a publish or subscribe
+type TopicPermissionError struct {
+	Topic  string
+	Action string
+}
+
+func (e *TopicPermissionError) Error() string {
+	return fmt.Sprintf("Roles do not allow %s on topic '%s'", e.Action, e.Topic)
+}
+
+//TopicPermissions checks publishes and subscribes against the topic permissions of a set of roles,
+//with the same wildcard rules as the broker
+type TopicPermissions struct {
+	lock   sync.RWMutex
+	grants []TopicPermission
+}
+
+//NewTopicPermissions returns a guard allowing what grants allow. Levels granted for the same topic add up.
+func NewTopicPermissions(grants []TopicPermission) *TopicPermissions {
+	p := &TopicPermissions{}
+	p.Set(grants)
+	return p
+}
+
+//roleTopics is the part of a role, as returned by GetRole, that holds its topic permissions.
+//Each topic has the shape AddTopicToRole sends.
+type roleTopics struct {
+	Name        string `json:"name"`
+	Permissions *struct {
+		Topics []struct {
+			ItemInfo struct {
+				Name string `json:"name"`
+			} `json:"itemInfo"`
+			Permissions *int `json:"permissions"`
+		} `json:"topics"`
+	} `json:"permissions"`
+}
+
+//TopicPermissionsFromRoles reads the topic permissions out of roles as returned by GetRole
+func TopicPermissionsFromRoles(roles []map[string]interface{}) (*TopicPermissions, error) {
+	var grants []TopicPermission
+	for _, raw := range roles {
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Bad role %v: %v", raw["name"], err)
+		}
+		role := &roleTopics{}
+		if err := json.Unmarshal(b, role); err != nil {
+			return nil, fmt.Errorf("Bad role %v: %v", raw["name"], err)
+		}
+		if role.Permissions == nil {
+			return nil, fmt.Errorf("Role '%s' has no permissions", role.Name)
+		}
+		for _, topic := range role.Permissions.Topics {
+			if topic.ItemInfo.Name == "" {
+				return nil, fmt.Errorf("Topic permission without a name in role '%s'", role.Name)
+			}
+			if topic.Permissions == nil {
+				return nil, fmt.Errorf("Topic '%s' has no permissions in role '%s'", topic.ItemInfo.Name, role.Name)
+			}
+			grants = append(grants, TopicPermission{Topic: topic.ItemInfo.Name, Level: *topic.Permissions})
+		}
+	}
+	return NewTopicPermissions(grants), nil
+}
+
+//TopicPermissionsForRoles loads the named roles and returns the topic permissions they grant together
+func (d *DevClient) TopicPermissionsForRoles(systemKey string, roleNames []string) (*TopicPermissions, error) {
+	roles := make([]map[string]interface{}, 0, len(roleNames))
+	for _, name := range roleNames {
+		role, err := d.GetRole(systemKey, name)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting role '%s': %v", name, err)
+		}
+		roles = append(roles, role)
+	}
+	return TopicPermissionsFromRoles(roles)
+}
+
+//UserTopicPermissions returns the topic permissions granted by a user's roles
+func (d *DevClient) UserTopicPermissions(systemKey, userId string) (*TopicPermissions, error) {
+	names, err := d.GetUserRoles(systemKey, userId)
+	if err != nil {
+		return nil, err
+	}
+	return d.TopicPermissionsForRoles(systemKey, names)
+}
+
+//DeviceTopicPermissions returns the topic permissions granted by a device's roles
+func (d *DevClient) DeviceTopicPermissions(systemKey, deviceName string) (*TopicPermissions, error) {
+	names, err := d.GetDeviceRoles(systemKey, deviceName)
+	if err != nil {
+		return nil, err
+	}
+	return d.TopicPermissionsForRoles(systemKey, names)
+}
+
+//LoadTopicPermissions loads the roles of the logged in user and checks topics against them from then on,
+//as SetTopicPermissions does. Calling it again after the roles have changed updates the checks.
+func (u *UserClient) LoadTopicPermissions() (*TopicPermissions, error) {
+	p, err := ownTopicPermissions(u, _USER_OWN_ROLES_PREAMBLE+u.SystemKey+"/roles", u.topicGuard)
+	if err != nil {
+		return nil, err
+	}
+	u.topicGuard = p
+	return p, nil
+}
+
+//LoadTopicPermissions loads the roles of the authenticated device and checks topics against them from then on,
+//as SetTopicPermissions does. Calling it again after the roles have changed updates the checks.
+func (d *DeviceClient) LoadTopicPermissions() (*TopicPermissions, error) {
+	p, err := ownTopicPermissions(d, _DEVICE_OWN_ROLES_PREAMBLE+d.SystemKey+"/"+d.DeviceName+"/roles", d.topicGuard)
+	if err != nil {
+		return nil, err
+	}
+	d.topicGuard = p
+	return p, nil
+}
+
+//ownTopicPermissions reads roles from endpoint. A guard already in use is updated in place, so the clients
+//checking against it see the new grants.
+func ownTopicPermissions(c cbClient, endpoint string, current *TopicPermissions) (*TopicPermissions, error) {
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := mapResponse(get(c, endpoint, nil, creds, nil))
+	if err != nil {
+		return nil, fmt.Errorf("Error getting roles: %v", err)
+	}
+	raw, ok := resp.Body.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Error getting roles: expected a list, got %T", resp.Body)
+	}
+	roles := make([]map[string]interface{}, 0, len(raw))
+	for _, r := range raw {
+		role, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Error getting roles: expected a role, got %T", r)
+		}
+		roles = append(roles, role)
+	}
+	p, err := TopicPermissionsFromRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return p, nil
+	}
+	current.Set(p.Grants())
+	return current, nil
+}
+
+//SetTopicPermissions makes every publish and subscribe the client makes on its mqtt connection, including those
+//of the ingester, presence tracker and shadows it starts, check topics against p before sending anything.
+//Passing nil turns the checks off.
+func (u *UserClient) SetTopicPermissions(p *TopicPermissions) {
+	u.topicGuard = p
+}
+
+//SetTopicPermissions makes every publish and subscribe the client makes on its mqtt connection, including those
+//of the ingester, presence tracker and shadows it starts, check topics against p before sending anything.
+//Passing nil turns the checks off.
+func (d *DeviceClient) SetTopicPermissions(p *TopicPermissions) {
+	d.topicGuard = p
+}
+
+//guardedMqtt is the client's mqtt connection with its topic permissions checked. Everything the client
+//publishes or subscribes to on its own connection goes through it.
+func (u *UserClient) guardedMqtt() MqttClient {
+	return guardMqttClient(u.MQTTClient, u.topicGuard)
+}
+
+//guardedMqtt is the client's mqtt connection with its topic permissions checked. Everything the client
+//publishes or subscribes to on its own connection goes through it.
+func (d *DeviceClient) guardedMqtt() MqttClient {
+	return guardMqttClient(d.MQTTClient, d.topicGuard)
+}
+
+//guardedMqttClient refuses publishes and subscribes its guard doesn't allow, before they reach the connection
+type guardedMqttClient struct {
+	MqttClient
+	guard *TopicPermissions
+}
+
+//guardMqttClient returns c checked against guard. Without a client or a guard, c is returned as it is.
+func guardMqttClient(c MqttClient, guard *TopicPermissions) MqttClient {
+	if c == nil || guard == nil {
+		return c
+	}
+	return &guardedMqttClient{MqttClient: c, guard: guard}
+}
+
+func (g *guardedMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if err := g.guard.CheckPublish(topic); err != nil {
+		return &refusedToken{err: err}
+	}
+	return g.MqttClient.Publish(topic, qos, retained, payload)
+}
+
+func (g *guardedMqttClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if err := g.guard.CheckSubscribe(topic); err != nil {
+		return &refusedToken{err: err}
+	}
+	return g.MqttClient.Subscribe(topic, qos, callback)
+}
+
+func (g *guardedMqttClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for filter := range filters {
+		if err := g.guard.CheckSubscribe(filter); err != nil {
+			return &refusedToken{err: err}
+		}
+	}
+	return g.MqttClient.SubscribeMultiple(filters, callback)
+}
+
+//refusedToken is the already completed token of a refused publish or subscribe. The embedded token is nil,
+//it is only there for the unexported method mqtt.Token requires.
+type refusedToken struct {
+	mqtt.Token
+	err error
+}
+
+func (t *refusedToken) Wait() bool {
+	return true
+}
+
+func (t *refusedToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (t *refusedToken) Error() error {
+	return t.err
+}
+
+//Set replaces the grants, after the roles have changed
+func (p *TopicPermissions) Set(grants []TopicPermission) {
+	merged := map[string]int{}
+	var order []string
+	for _, g := range grants {
+		if _, ok := merged[g.Topic]; !ok {
+			order = append(order, g.Topic)
+		}
+		merged[g.Topic] |= g.Level
+	}
+	rval := make([]TopicPermission, 0, len(order))
+	for _, topic := range order {
+		rval = append(rval, TopicPermission{Topic: topic, Level: merged[topic]})
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.grants = rval
+}
+
+//Grants returns the merged grants
+func (p *TopicPermissions) Grants() []TopicPermission {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return append([]TopicPermission{}, p.grants...)
+}
+
+//CanPublish reports whether a grant with PERM_CREATE matches topic
+func (p *TopicPermissions) CanPublish(topic string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, g := range p.grants {
+		if g.Level&PERM_CREATE != 0 && TopicMatches(g.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+//CanSubscribe reports whether a grant with PERM_READ covers every topic filter can match
+func (p *TopicPermissions) CanSubscribe(filter string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, g := range p.grants {
+		if g.Level&PERM_READ != 0 && TopicFilterCovers(g.Topic, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+//CheckPublish returns a *TopicPermissionError if topic can't be published to. A nil guard allows everything.
+func (p *TopicPermissions) CheckPublish(topic string) error {
+	if p == nil {
+		return nil
+	}
+	if err := ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if !p.CanPublish(topic) {
+		return &TopicPermissionError{Topic: topic, Action: "publish"}
+	}
+	return nil
+}
+
+//CheckSubscribe returns a *TopicPermissionError if filter can't be subscribed to. A nil guard allows everything.
+func (p *TopicPermissions) CheckSubscribe(filter string) error {
+	if p == nil {
+		return nil
+	}
+	if err := ValidateTopicFilter(filter); err != nil {
+		return err
+	}
+	if !p.CanSubscribe(filter) {
+		return &TopicPermissionError{Topic: filter, Action: "subscribe"}
+	}
+	return nil
+}
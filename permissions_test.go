@@ -0,0 +1,89 @@
+package GoSDK
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//ownRolesFixtures are role lists in the shape the self loaders read, topics as AddTopicToRole writes them
+var ownRolesFixtures = map[string]string{
+	"/api/v/4/user/key/roles":         `[{"name":"reader","permissions":{"topics":[{"itemInfo":{"name":"sensors/+"},"permissions":1}]}}]`,
+	"/api/v/4/devices/key/dev1/roles": `[{"name":"writer","permissions":{"topics":[{"itemInfo":{"name":"sensors/dev1"},"permissions":2}]}}]`,
+	"/api/v/4/devices/key/dev2/roles": `{"roles":[]}`,
+	"/api/v/4/devices/key/dev3/roles": `[{"name":"broken","permissions":{"topics":[{"itemInfo":{"name":"a"}}]}}]`,
+}
+
+func newOwnRolesTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := ownRolesFixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+func TestLoadTopicPermissions(t *testing.T) {
+	srv := newOwnRolesTestServer()
+	defer srv.Close()
+
+	u := NewUserClientWithServiceAccountAndAddrs(srv.URL, "", "key", "secret", "user@example.com", "token")
+	p, err := u.LoadTopicPermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.CanSubscribe("sensors/a") || p.CanPublish("sensors/a") {
+		t.Errorf("got grants %v", p.Grants())
+	}
+	if u.topicGuard != p {
+		t.Error("the loaded permissions are not checked")
+	}
+
+	d := NewDeviceClientWithServiceAccountAndAddrs(srv.URL, "", "key", "secret", "dev1", "token")
+	d.SetTopicPermissions(NewTopicPermissions(nil))
+	guard := d.topicGuard
+	if _, err := d.LoadTopicPermissions(); err != nil {
+		t.Fatal(err)
+	}
+	if d.topicGuard != guard || !guard.CanPublish("sensors/dev1") {
+		t.Errorf("the guard in use was not updated: %v", guard.Grants())
+	}
+
+	for _, name := range []string{"dev2", "dev3", "missing"} {
+		d := NewDeviceClientWithServiceAccountAndAddrs(srv.URL, "", "key", "secret", name, "token")
+		if _, err := d.LoadTopicPermissions(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if d.topicGuard != nil {
+			t.Errorf("%s: a failed load turned the checks on", name)
+		}
+	}
+}
+
+//the guarded connection refuses before reaching the connection underneath, which is nil here
+func TestGuardedMqttRefuses(t *testing.T) {
+	var c MqttClient = &guardedMqttClient{guard: NewTopicPermissions([]TopicPermission{{Topic: "sensors/+", Level: PERM_READ}})}
+
+	_, err := subscribeWithOptions(c, "sensors/#", 0, SubscribeOptions{}, nil)
+	if perr, ok := err.(*TopicPermissionError); !ok || perr.Action != "subscribe" {
+		t.Errorf("subscribe: got %v", err)
+	}
+	err = publish(c, "sensors/a", []byte("x"), 0, 0)
+	if perr, ok := err.(*TopicPermissionError); !ok || perr.Action != "publish" {
+		t.Errorf("publish: got %v", err)
+	}
+	if err := publish(c, "sensors/+", []byte("x"), 0, 0); err == nil {
+		t.Error("expected a wildcard topic name to be refused")
+	}
+	ret := c.SubscribeMultiple(map[string]byte{"sensors/a": 0, "other": 0}, nil)
+	if !ret.WaitTimeout(0) || ret.Error() == nil {
+		t.Error("expected a subscription to several filters to be refused when one is not allowed")
+	}
+
+	if guardMqttClient(nil, NewTopicPermissions(nil)) != nil {
+		t.Error("a missing connection should stay missing")
+	}
+}
@@ -0,0 +1,356 @@
+package GoSDK
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	//DefaultPresenceTopic is the status topic template used when PresenceOptions.Topic is empty
+	DefaultPresenceTopic = "presence/{device}"
+	//PresenceOnline is the birth payload devices publish to their status topic
+	PresenceOnline = "online"
+	//PresenceOffline is the last will payload the broker publishes to a device's status topic when it drops
+	PresenceOffline = "offline"
+
+	_PRESENCE_EVENT_BUFFER = 100
+)
+
+//PresenceOptions configures a PresenceTracker
+type PresenceOptions struct {
+	SystemKey string
+	//PollInterval is how often the connected device list is fetched. Zero disables polling.
+	PollInterval time.Duration
+	//Topic is the template of the per device status topic, with a {device} segment. Defaults to DefaultPresenceTopic.
+	Topic string
+	Qos   int
+}
+
+//DevicePresence is the known state of a device
+type DevicePresence struct {
+	Device string
+	Online bool
+	//LastSeen is the last time the device was seen connected, by a poll or a message on its status topic
+	LastSeen time.Time
+	//Changed is when Online last flipped
+	Changed time.Time
+}
+
+//PresenceEvent is sent when a device goes online or offline
+type PresenceEvent struct {
+	Device string
+	Online bool
+	Time   time.Time
+	//Source is "poll", "birth" or "will"
+	Source string
+}
+
+//PresenceTracker keeps a live map of device presence, from polling the platform's connection list
+//and from birth and last will messages on the devices' status topics
+type PresenceTracker struct {
+	client    cbClient
+	systemKey string
+	lock      sync.RWMutex
+	devices   map[string]*DevicePresence
+	events    chan PresenceEvent
+	router    *TopicRouter
+	stop      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+//TrackPresence starts a presence tracker. The status topics are followed through the client's mqtt connection, if it has one.
+func (u *UserClient) TrackPresence(opts PresenceOptions) (*PresenceTracker, error) {
+	return newPresenceTracker(u, u.guardedMqtt(), opts)
+}
+
+//TrackPresence starts a presence tracker. The status topics are followed through the client's mqtt connection, if it has one.
+func (d *DevClient) TrackPresence(opts PresenceOptions) (*PresenceTracker, error) {
+	return newPresenceTracker(d, d.MQTTClient, opts)
+}
+
+//PresenceLastWill returns the last will a device should connect with, so the broker marks it offline when it drops.
+//An empty topic uses DefaultPresenceTopic.
+func PresenceLastWill(topic, device string) *LastWillPacket {
+	return &LastWillPacket{
+		Topic:  presenceTopic(topic, device),
+		Body:   PresenceOffline,
+		Qos:    QOS_AtLeastOnce,
+		Retain: true,
+	}
+}
+
+//AnnouncePresence publishes the birth message of a device, once it has connected with PresenceLastWill
+func (d *DeviceClient) AnnouncePresence(topic string) error {
+	if d.MQTTClient == nil {
+		return fmt.Errorf("MQTTClient is uninitialized")
+	}
+	ret := d.guardedMqtt().Publish(presenceTopic(topic, d.DeviceName), QOS_AtLeastOnce, true, []byte(PresenceOnline))
+	ret.Wait()
+	return ret.Error()
+}
+
+func presenceTopic(topic, device string) string {
+	if topic == "" {
+		topic = DefaultPresenceTopic
+	}
+	return strings.Replace(topic, "{device}", device, 1)
+}
+
+func newPresenceTracker(c cbClient, mqc MqttClient, opts PresenceOptions) (*PresenceTracker, error) {
+	if opts.Topic == "" {
+		opts.Topic = DefaultPresenceTopic
+	}
+	if !strings.Contains(opts.Topic, "{device}") {
+		return nil, fmt.Errorf("Presence topic '%s' must have a {device} segment", opts.Topic)
+	}
+	if opts.PollInterval > 0 && opts.SystemKey == "" {
+		return nil, fmt.Errorf("SystemKey is required to poll connected devices")
+	}
+	t := &PresenceTracker{
+		client:    c,
+		systemKey: opts.SystemKey,
+		devices:   map[string]*DevicePresence{},
+		events:    make(chan PresenceEvent, _PRESENCE_EVENT_BUFFER),
+		stop:      make(chan struct{}),
+	}
+	if mqc != nil {
+		t.router = NewTopicRouter(mqc, SubscribeOptions{})
+		err := t.router.Handle(opts.Topic, opts.Qos, func(msg *mqttTypes.Publish, params RouteParams) {
+			t.statusMessage(params.Named["device"], msg.Payload)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.PollInterval > 0 {
+		if err := t.poll(); err != nil {
+			t.Stop()
+			return nil, err
+		}
+		t.wg.Add(1)
+		go t.pollLoop(opts.PollInterval)
+	}
+	return t, nil
+}
+
+//Events returns the channel presence changes are sent on. Events are dropped if it is not drained.
+//The channel is closed by Stop.
+func (t *PresenceTracker) Events() <-chan PresenceEvent {
+	return t.events
+}
+
+//Get returns the presence of device, and whether the tracker knows of it
+func (t *PresenceTracker) Get(device string) (DevicePresence, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	p, ok := t.devices[device]
+	if !ok {
+		return DevicePresence{}, false
+	}
+	return *p, true
+}
+
+//Snapshot returns a copy of the presence of every known device
+func (t *PresenceTracker) Snapshot() map[string]DevicePresence {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	rval := make(map[string]DevicePresence, len(t.devices))
+	for name, p := range t.devices {
+		rval[name] = *p
+	}
+	return rval
+}
+
+//Online returns the names of the devices currently online
+func (t *PresenceTracker) Online() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var names []string
+	for name, p := range t.devices {
+		if p.Online {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//Stop unsubscribes from the status topics, ends polling and closes the event channel
+func (t *PresenceTracker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		if t.router != nil {
+			t.router.Close()
+		}
+		t.wg.Wait()
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		close(t.events)
+	})
+}
+
+func (t *PresenceTracker) pollLoop(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//a failed poll leaves the states as they were, the next one will catch up
+			t.poll()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+//Check looks up the connections of one device with DeviceConnections, and updates its state without waiting
+//for the next poll. It reports whether the device is connected.
+func (t *PresenceTracker) Check(device string) (bool, error) {
+	if t.systemKey == "" {
+		return false, fmt.Errorf("SystemKey is required to check a device's connections")
+	}
+	body, err := DeviceConnections(t.client, t.systemKey, device)
+	if err != nil {
+		return false, fmt.Errorf("Error getting connections of device '%s': %v", device, err)
+	}
+	rows, err := presenceRows(body, "Device connections")
+	if err != nil {
+		return false, err
+	}
+	online := len(rows) > 0
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.set(device, online, time.Now(), "poll")
+	return online, nil
+}
+
+//poll asks ConnectedDeviceCount how many devices are connected, and fetches the ConnectedDevices list only when
+//some are. Devices in the list are marked online, and every other known device offline.
+func (t *PresenceTracker) poll() error {
+	countBody, err := ConnectedDeviceCount(t.client, t.systemKey)
+	if err != nil {
+		return fmt.Errorf("Error getting connected device count: %v", err)
+	}
+	count, err := connectedDeviceCount(countBody)
+	if err != nil {
+		return err
+	}
+	connected := map[string]bool{}
+	if count > 0 {
+		body, err := ConnectedDevices(t.client, t.systemKey)
+		if err != nil {
+			return fmt.Errorf("Error getting connected devices: %v", err)
+		}
+		if connected, err = connectedDeviceNames(body); err != nil {
+			return err
+		}
+		//rather than mark every device offline, treat a list without devices while the count has some as a failed poll
+		if len(connected) == 0 {
+			return fmt.Errorf("Connected device count is %d, but the connected devices list is empty", count)
+		}
+	}
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for name := range connected {
+		t.set(name, true, now, "poll")
+	}
+	for name, p := range t.devices {
+		if p.Online && !connected[name] {
+			t.set(name, false, now, "poll")
+		}
+	}
+	return nil
+}
+
+func (t *PresenceTracker) statusMessage(device string, payload []byte) {
+	if device == "" {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if strings.TrimSpace(string(payload)) == PresenceOffline {
+		t.set(device, false, time.Now(), "will")
+		return
+	}
+	t.set(device, true, time.Now(), "birth")
+}
+
+//set records a device's state and emits an event if it changed, the caller must hold the lock
+func (t *PresenceTracker) set(device string, online bool, now time.Time, source string) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	p, ok := t.devices[device]
+	if !ok {
+		p = &DevicePresence{Device: device}
+		t.devices[device] = p
+	}
+	if online {
+		p.LastSeen = now
+	}
+	if ok && p.Online == online {
+		return
+	}
+	p.Online = online
+	p.Changed = now
+	select {
+	case t.events <- PresenceEvent{Device: device, Online: online, Time: now, Source: source}:
+	default:
+	}
+}
+
+//The platform's connection responses aren't documented. The tracker reads ConnectedDevices and DeviceConnections
+//as a "DATA" list of rows, with the device's "name" in the rows of ConnectedDevices, and ConnectedDeviceCount as a
+//"count", like the other count endpoints. Responses in any other shape are errors, rather than every device
+//being marked offline.
+
+//presenceRows reads the "DATA" list of rows of a connection response
+func presenceRows(body map[string]interface{}, what string) ([]map[string]interface{}, error) {
+	list, ok := body["DATA"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s response has no DATA list: %+v", what, body)
+	}
+	rows, err := convertToMapStringInterface(list)
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s response: %v", strings.ToLower(what), err)
+	}
+	return rows, nil
+}
+
+//connectedDeviceNames reads the device names out of a ConnectedDevices response
+func connectedDeviceNames(body map[string]interface{}) (map[string]bool, error) {
+	rows, err := presenceRows(body, "Connected devices")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, row := range rows {
+		name, ok := row["name"].(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Connected device without a name: %+v", row)
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+//connectedDeviceCount reads a ConnectedDeviceCount response
+func connectedDeviceCount(body map[string]interface{}) (int64, error) {
+	v, ok := body["count"]
+	if !ok {
+		return 0, fmt.Errorf("Connected device count not present in response from platform %+v", body)
+	}
+	count, err := toInt64(v)
+	if err != nil {
+		return 0, fmt.Errorf("Bad connected device count: %v", err)
+	}
+	return count, nil
+}
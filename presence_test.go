@@ -0,0 +1,83 @@
+package GoSDK
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//presenceFixtures are connection responses in the shapes the tracker reads
+var presenceFixtures = map[string]string{
+	"/api/v/4/devices/key/connectioncount":      `{"count":2}`,
+	"/api/v/4/devices/key/connections":          `{"DATA":[{"name":"a"},{"name":"b"}]}`,
+	"/api/v/4/devices/key/connections/a":        `{"DATA":[{"name":"a"}]}`,
+	"/api/v/4/devices/key/connections/gone":     `{"DATA":[]}`,
+	"/api/v/4/devices/other/connectioncount":    `{"count":1}`,
+	"/api/v/4/devices/other/connections":        `{"devices":["a"]}`,
+	"/api/v/4/devices/nobody/connectioncount":   `{"count":0}`,
+	"/api/v/4/devices/nobody/connections":       `{"DATA":[{"name":"a"}]}`,
+	"/api/v/4/devices/mismatch/connectioncount": `{"count":3}`,
+	"/api/v/4/devices/mismatch/connections":     `{"DATA":[]}`,
+}
+
+func newPresenceTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := presenceFixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+func TestPresencePoll(t *testing.T) {
+	srv := newPresenceTestServer()
+	defer srv.Close()
+	d := NewDevClientWithTokenAndAddrs(srv.URL, "", "token", "dev@example.com")
+	tr := &PresenceTracker{client: d, systemKey: "key", devices: map[string]*DevicePresence{}, events: make(chan PresenceEvent, 10), stop: make(chan struct{})}
+	tr.devices["c"] = &DevicePresence{Device: "c", Online: true}
+	if err := tr.poll(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a": true, "b": true, "c": false} {
+		if p, _ := tr.Get(name); p.Online != want {
+			t.Errorf("%s: online %v, want %v", name, p.Online, want)
+		}
+	}
+
+	online, err := tr.Check("gone")
+	if err != nil || online {
+		t.Errorf("gone: got %v, %v", online, err)
+	}
+	online, err = tr.Check("a")
+	if err != nil || !online {
+		t.Errorf("a: got %v, %v", online, err)
+	}
+
+	//no connected devices marks every device offline without reading the list
+	tr.systemKey = "nobody"
+	if err := tr.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := tr.Get("a"); p.Online {
+		t.Error("a should be offline")
+	}
+}
+
+func TestPresencePollRejectsUnknownShapes(t *testing.T) {
+	srv := newPresenceTestServer()
+	defer srv.Close()
+	d := NewDevClientWithTokenAndAddrs(srv.URL, "", "token", "dev@example.com")
+	for _, key := range []string{"other", "mismatch"} {
+		tr := &PresenceTracker{client: d, systemKey: key, devices: map[string]*DevicePresence{}, events: make(chan PresenceEvent, 10), stop: make(chan struct{})}
+		tr.devices["a"] = &DevicePresence{Device: "a", Online: true}
+		if err := tr.poll(); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+		if p, _ := tr.Get("a"); !p.Online {
+			t.Errorf("%s: a failed poll must leave devices as they were", key)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package GoSDK
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Mqtt protocol versions, as sent in the CONNECT packet
+const (
+	MQTTv31  = 3
+	MQTTv311 = 4
+	MQTTv5   = 5
+)
+
+//ErrMQTT5Unsupported is returned when asking for MQTT 5 on the MqttClient connection. The mqtt library
+//behind MqttClient only speaks 3.1 and 3.1.1; MQTT 5 connections are made with InitializeMQTT5 instead.
+var ErrMQTT5Unsupported = errors.New("MqttClient does not support MQTT 5, use InitializeMQTT5")
+
+//SetMqttProtocolVersion selects the protocol version used by later calls to InitializeMQTT and AuthenticateMQTT.
+//Zero, the default, lets the mqtt client try 3.1.1 and fall back to 3.1.
+func (b *client) SetMqttProtocolVersion(version uint) error {
+	switch version {
+	case 0, MQTTv31, MQTTv311:
+		b.mqttVersion = version
+		return nil
+	case MQTTv5:
+		return ErrMQTT5Unsupported
+	default:
+		return fmt.Errorf("Unknown mqtt protocol version %d", version)
+	}
+}
+
+//MqttProtocolVersion returns the protocol version selected with SetMqttProtocolVersion
+func (b *client) MqttProtocolVersion() uint {
+	return b.mqttVersion
+}
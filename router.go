@@ -0,0 +1,282 @@
+package GoSDK
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+//RouteParams describes how a message's topic matched a route
+type RouteParams struct {
+	//Pattern is the pattern the route was registered with
+	Pattern string
+	//Named holds the levels matched by {name} template segments
+	Named map[string]string
+	//Wildcards holds the levels matched by '+' and {name} segments, in order
+	Wildcards []string
+	//Rest is the remainder of the topic matched by a trailing '#'
+	Rest string
+}
+
+//RouteHandler handles a message dispatched by a TopicRouter
+type RouteHandler func(msg *mqttTypes.Publish, params RouteParams)
+
+type topicRoute struct {
+	pattern string
+	filter  []string
+	names   []string
+	rank    []int
+	qos     int
+	handler RouteHandler
+}
+
+//TopicRouter dispatches messages to handlers registered for mqtt wildcard patterns, like "devices/+/telemetry/#",
+//or named templates, like "devices/{id}/telemetry". Each message goes to the single most specific matching route.
+//Patterns that are covered by another registered pattern share its broker subscription.
+type TopicRouter struct {
+	lock   sync.RWMutex
+	client MqttClient
+	opts   SubscribeOptions
+	routes []*topicRoute
+	subs   map[string]int
+}
+
+//NewTopicRouter allocates a router that subscribes through c. opts applies to each underlying subscription.
+func NewTopicRouter(c MqttClient, opts SubscribeOptions) *TopicRouter {
+	return &TopicRouter{
+		client: c,
+		opts:   opts,
+		subs:   map[string]int{},
+	}
+}
+
+//Handle registers handler for pattern, replacing any handler already registered for the same pattern
+func (r *TopicRouter) Handle(pattern string, qos int, handler RouteHandler) error {
+	if handler == nil {
+		return fmt.Errorf("Handler is required")
+	}
+	rt, err := parseRoutePattern(pattern)
+	if err != nil {
+		return err
+	}
+	rt.qos = qos
+	rt.handler = handler
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	replaced := false
+	for i, existing := range r.routes {
+		if existing.pattern == pattern {
+			r.routes[i] = rt
+			replaced = true
+		}
+	}
+	if !replaced {
+		r.routes = append(r.routes, rt)
+	}
+	return r.sync()
+}
+
+//Remove unregisters the handler for pattern
+func (r *TopicRouter) Remove(pattern string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kept := r.routes[:0]
+	for _, rt := range r.routes {
+		if rt.pattern != pattern {
+			kept = append(kept, rt)
+		}
+	}
+	if len(kept) == len(r.routes) {
+		return fmt.Errorf("No route registered for '%s'", pattern)
+	}
+	r.routes = kept
+	return r.sync()
+}
+
+//Subscriptions returns the topic filters the router is subscribed to on the broker
+func (r *TopicRouter) Subscriptions() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.filters()
+}
+
+//Close removes every route and unsubscribes from the broker
+func (r *TopicRouter) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes = nil
+	return r.sync()
+}
+
+//parseRoutePattern turns a pattern into an mqtt filter, remembering the names of template segments
+func parseRoutePattern(pattern string) (*topicRoute, error) {
+	levels := splitTopic(pattern)
+	rt := &topicRoute{
+		pattern: pattern,
+		filter:  make([]string, len(levels)),
+		names:   make([]string, len(levels)),
+		rank:    make([]int, len(levels)),
+	}
+	for i, level := range levels {
+		switch {
+		case strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}"):
+			name := level[1 : len(level)-1]
+			if name == "" {
+				return nil, fmt.Errorf("Invalid pattern '%s': empty parameter name", pattern)
+			}
+			rt.filter[i] = "+"
+			rt.names[i] = name
+			rt.rank[i] = 1
+		case level == "+":
+			rt.filter[i] = level
+			rt.rank[i] = 1
+		case level == "#":
+			rt.filter[i] = level
+			rt.rank[i] = 0
+		default:
+			rt.filter[i] = level
+			rt.rank[i] = 2
+		}
+	}
+	if err := ValidateTopicFilter(strings.Join(rt.filter, "/")); err != nil {
+		return nil, fmt.Errorf("Invalid pattern '%s': %s", pattern, err.Error())
+	}
+	return rt, nil
+}
+
+//moreSpecific reports whether a should win over b when both match a topic.
+//Levels are compared in order: a literal beats '+', which beats '#'. When one route is a prefix of the
+//other, the longer one can only have matched through a trailing '#' that consumed nothing, so the shorter wins.
+func (a *topicRoute) moreSpecific(b *topicRoute) bool {
+	for i := 0; i < len(a.rank) && i < len(b.rank); i++ {
+		if a.rank[i] != b.rank[i] {
+			return a.rank[i] > b.rank[i]
+		}
+	}
+	return len(a.rank) < len(b.rank)
+}
+
+func (rt *topicRoute) params(topic []string, restAt int) RouteParams {
+	p := RouteParams{
+		Pattern: rt.pattern,
+		Named:   map[string]string{},
+	}
+	for i, level := range rt.filter {
+		if level != "+" {
+			continue
+		}
+		p.Wildcards = append(p.Wildcards, topic[i])
+		if rt.names[i] != "" {
+			p.Named[rt.names[i]] = topic[i]
+		}
+	}
+	if restAt < len(topic) {
+		p.Rest = strings.Join(topic[restAt:], "/")
+	}
+	return p
+}
+
+//filters returns the sorted broker filters, the caller must hold the lock
+func (r *TopicRouter) filters() []string {
+	rval := make([]string, 0, len(r.subs))
+	for filter := range r.subs {
+		rval = append(rval, filter)
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+//sync brings the broker subscriptions in line with the routes, the caller must hold the lock
+func (r *TopicRouter) sync() error {
+	needed := map[string]int{}
+	for i, rt := range r.routes {
+		covered := false
+		for j, other := range r.routes {
+			if i == j || !filterCovers(other.filter, rt.filter) {
+				continue
+			}
+			//identical filters are kept once, by the first route that registered one
+			if !filterCovers(rt.filter, other.filter) || j < i {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		filter := strings.Join(rt.filter, "/")
+		qos := rt.qos
+		for _, other := range r.routes {
+			if filterCovers(rt.filter, other.filter) && other.qos > qos {
+				qos = other.qos
+			}
+		}
+		needed[filter] = qos
+	}
+	var firstErr error
+	for filter, qos := range needed {
+		if current, ok := r.subs[filter]; ok && current == qos {
+			continue
+		}
+		levels := splitTopic(filter)
+		_, err := subscribeWithOptions(r.client, filter, qos, r.opts, func(msg *mqttTypes.Publish) {
+			r.dispatch(levels, msg)
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		r.subs[filter] = qos
+	}
+	remaining := map[string]int{}
+	for filter, qos := range r.subs {
+		if _, ok := needed[filter]; ok {
+			remaining[filter] = qos
+			continue
+		}
+		if err := unsubscribe(r.client, filter); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.subs = remaining
+	return firstErr
+}
+
+//dispatch is called by the subscription for filter. Since the mqtt client hands a message to every
+//subscription whose filter matches, only the first matching filter dispatches it.
+func (r *TopicRouter) dispatch(filter []string, msg *mqttTypes.Publish) {
+	topic := splitTopic(msg.Topic.Whole)
+	r.lock.RLock()
+	owner := ""
+	for _, f := range r.filters() {
+		if _, ok := matchTopicLevels(splitTopic(f), topic); ok {
+			owner = f
+			break
+		}
+	}
+	if owner != strings.Join(filter, "/") {
+		r.lock.RUnlock()
+		return
+	}
+	var best *topicRoute
+	bestRest := 0
+	for _, rt := range r.routes {
+		restAt, ok := matchTopicLevels(rt.filter, topic)
+		if !ok {
+			continue
+		}
+		if best == nil || rt.moreSpecific(best) {
+			best = rt
+			bestRest = restAt
+		}
+	}
+	r.lock.RUnlock()
+	if best != nil {
+		best.handler(msg, best.params(topic, bestRest))
+	}
+}
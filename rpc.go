@@ -0,0 +1,317 @@
+package GoSDK
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	_RPC_REPLY_PREFIX    = "rpc/replies"
+	_RPC_DEFAULT_TIMEOUT = 30 * time.Second
+)
+
+//ErrRPCTimeout is returned by Request when no response arrives in time
+var ErrRPCTimeout = errors.New("Timed out waiting for rpc response")
+
+//ErrRPCClosed is returned by Request when the RPC is closed while waiting for a response
+var ErrRPCClosed = errors.New("RPC closed")
+
+//RPCError is returned by Request when the remote handler failed
+type RPCError struct {
+	Topic   string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("Error handling rpc request on '%s': %s", e.Topic, e.Message)
+}
+
+//RPCHandler answers a request received on topic. The returned error is sent back to the caller as an RPCError.
+type RPCHandler func(topic string, payload []byte) ([]byte, error)
+
+//RPCOptions configures an RPC
+type RPCOptions struct {
+	//ReplyTopic is where responses to this client's requests are sent. Defaults to a random topic under ReplyPrefix.
+	ReplyTopic string
+	//ReplyPrefix limits the topics handlers send responses to. Requests whose reply topic isn't under it are
+	//dropped, so a request can't make the handler publish to any topic it is allowed to. Defaults to "rpc/replies".
+	ReplyPrefix string
+	//OnError is called with requests dropped for their reply topic and with responses that could not be published.
+	//They are ignored if it is nil.
+	OnError func(err error)
+	//Qos is used for requests. Responses are sent with the qos of the request.
+	Qos       int
+	Subscribe SubscribeOptions
+}
+
+//rpcEnvelope wraps payloads on the wire. Mqtt 3.1.1 has no message properties, so the
+//correlation id and reply topic travel with the payload.
+type rpcEnvelope struct {
+	CorrelationID string `json:"correlation_id"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+	Payload       []byte `json:"payload"`
+	Error         string `json:"error,omitempty"`
+}
+
+//RPC implements request/response on top of mqtt publish and subscribe
+type RPC struct {
+	client   MqttClient
+	opts     RPCOptions
+	idPrefix string
+	nextID   uint64
+	lock     sync.Mutex
+	replySub *Subscription
+	handlers map[string]*Subscription
+	pending  sync.Map
+	closed   bool
+}
+
+//rpcCall is a request waiting for its response. done guards resp, which is either sent
+//the response or closed, exactly once.
+type rpcCall struct {
+	resp chan *rpcEnvelope
+	done sync.Once
+}
+
+func (c *rpcCall) finish(env *rpcEnvelope) {
+	c.done.Do(func() {
+		if env == nil {
+			close(c.resp)
+			return
+		}
+		c.resp <- env
+	})
+}
+
+//NewRPC allocates an RPC that publishes and subscribes through c
+func NewRPC(c MqttClient, opts RPCOptions) (*RPC, error) {
+	//the reply topic and correlation ids must not be guessable, or other clients could answer in our place
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReplyPrefix == "" {
+		opts.ReplyPrefix = _RPC_REPLY_PREFIX
+	}
+	opts.ReplyPrefix = strings.TrimSuffix(opts.ReplyPrefix, "/")
+	if opts.ReplyTopic == "" {
+		opts.ReplyTopic = opts.ReplyPrefix + "/" + id
+	}
+	return &RPC{
+		client:   c,
+		opts:     opts,
+		idPrefix: id,
+		handlers: map[string]*Subscription{},
+	}, nil
+}
+
+//randomID returns 10 bytes from crypto/rand in hex, in the same format as NewClientID
+func randomID() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Error generating id: %v", err)
+	}
+	return fmt.Sprintf("%X", buf), nil
+}
+
+//Request publishes payload to topic and waits up to timeout for the response. A timeout of zero waits 30 seconds.
+func (r *RPC) Request(topic string, payload []byte, timeout time.Duration) ([]byte, error) {
+	if err := ValidateTopicName(topic); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = _RPC_DEFAULT_TIMEOUT
+	}
+	if err := r.listen(); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%s-%d", r.idPrefix, atomic.AddUint64(&r.nextID, 1))
+	call := &rpcCall{resp: make(chan *rpcEnvelope, 1)}
+	r.pending.Store(id, call)
+	defer r.pending.Delete(id)
+
+	body, err := json.Marshal(&rpcEnvelope{
+		CorrelationID: id,
+		ReplyTo:       r.opts.ReplyTopic,
+		Payload:       payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := publish(r.client, topic, body, r.opts.Qos, 0); err != nil {
+		return nil, fmt.Errorf("Error publishing rpc request: %v", err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case env, ok := <-call.resp:
+		if !ok {
+			return nil, ErrRPCClosed
+		}
+		if env.Error != "" {
+			return nil, &RPCError{Topic: topic, Message: env.Error}
+		}
+		return env.Payload, nil
+	case <-timer.C:
+		return nil, ErrRPCTimeout
+	}
+}
+
+//Pending returns the number of requests waiting for a response
+func (r *RPC) Pending() int {
+	count := 0
+	r.pending.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+//Handle subscribes to topic and answers each request received on it with handler.
+//Requests are handled concurrently. Messages that are not rpc requests are ignored.
+func (r *RPC) Handle(topic string, qos int, handler RPCHandler) error {
+	if handler == nil {
+		return fmt.Errorf("Handler is required")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrRPCClosed
+	}
+	sub, err := subscribeWithOptions(r.client, topic, qos, r.opts.Subscribe, func(msg *mqttTypes.Publish) {
+		env := &rpcEnvelope{}
+		if err := json.Unmarshal(msg.Payload, env); err != nil || env.CorrelationID == "" || env.ReplyTo == "" {
+			return
+		}
+		go r.serve(handler, msg, env)
+	})
+	if err != nil {
+		return err
+	}
+	r.handlers[topic] = sub
+	return nil
+}
+
+//Remove stops answering requests on topic
+func (r *RPC) Remove(topic string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sub, ok := r.handlers[topic]
+	if !ok {
+		return fmt.Errorf("No rpc handler registered for '%s'", topic)
+	}
+	kept := map[string]*Subscription{}
+	for t, s := range r.handlers {
+		if t != topic {
+			kept[t] = s
+		}
+	}
+	r.handlers = kept
+	return sub.Unsubscribe()
+}
+
+//Close unsubscribes every handler and the reply topic. Requests still waiting fail with ErrRPCClosed.
+func (r *RPC) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	var firstErr error
+	for _, sub := range r.handlers {
+		if err := sub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.handlers = map[string]*Subscription{}
+	if r.replySub != nil {
+		if err := r.replySub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		r.replySub = nil
+	}
+	r.pending.Range(func(id, call interface{}) bool {
+		r.pending.Delete(id)
+		call.(*rpcCall).finish(nil)
+		return true
+	})
+	return firstErr
+}
+
+//listen subscribes to the reply topic the first time a request is made
+func (r *RPC) listen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrRPCClosed
+	}
+	if r.replySub != nil {
+		return nil
+	}
+	sub, err := subscribeWithOptions(r.client, r.opts.ReplyTopic, r.opts.Qos, r.opts.Subscribe, r.receive)
+	if err != nil {
+		return fmt.Errorf("Error subscribing to rpc reply topic: %v", err)
+	}
+	r.replySub = sub
+	return nil
+}
+
+//receive hands a response to the request waiting for it. Late and unknown responses are dropped.
+func (r *RPC) receive(msg *mqttTypes.Publish) {
+	env := &rpcEnvelope{}
+	if err := json.Unmarshal(msg.Payload, env); err != nil {
+		return
+	}
+	call, ok := r.pending.Load(env.CorrelationID)
+	if !ok {
+		return
+	}
+	r.pending.Delete(env.CorrelationID)
+	call.(*rpcCall).finish(env)
+}
+
+//replyAllowed reports whether topic is a topic name under the reply prefix
+func (r *RPC) replyAllowed(topic string) bool {
+	return strings.HasPrefix(topic, r.opts.ReplyPrefix+"/") && ValidateTopicName(topic) == nil
+}
+
+func (r *RPC) fail(err error) {
+	if r.opts.OnError != nil {
+		r.opts.OnError(err)
+	}
+}
+
+func (r *RPC) serve(handler RPCHandler, msg *mqttTypes.Publish, req *rpcEnvelope) {
+	if !r.replyAllowed(req.ReplyTo) {
+		r.fail(fmt.Errorf("Dropped rpc request on '%s': reply topic '%s' is not under '%s'", msg.Topic.Whole, req.ReplyTo, r.opts.ReplyPrefix))
+		return
+	}
+	resp := &rpcEnvelope{CorrelationID: req.CorrelationID}
+	payload, err := handler(msg.Topic.Whole, req.Payload)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Payload = payload
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		r.fail(fmt.Errorf("Error encoding rpc response: %v", err))
+		return
+	}
+	qos := 0
+	if msg.Header != nil {
+		qos = int(msg.Header.QOS)
+	}
+	if err := publish(r.client, req.ReplyTo, body, qos, 0); err != nil {
+		r.fail(fmt.Errorf("Error publishing rpc response to '%s': %v", req.ReplyTo, err))
+	}
+}
@@ -0,0 +1,449 @@
+package GoSDK
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	_SECURE_ENVELOPE_VERSION = 1
+	//SignHMAC signs with HMAC-SHA256 and a shared key
+	SignHMAC = "hmac-sha256"
+	//SignEd25519 signs with an Ed25519 private key, receivers only need the public key
+	SignEd25519 = "ed25519"
+)
+
+var (
+	//ErrUnsigned is returned for a message without a signature when signatures are required
+	ErrUnsigned = errors.New("Message is not signed")
+	//ErrBadSignature is returned for a message whose signature does not verify
+	ErrBadSignature = errors.New("Message signature is invalid")
+	//ErrNotEncrypted is returned for a plaintext message when encryption is required
+	ErrNotEncrypted = errors.New("Message is not encrypted")
+	//ErrNotSecured is returned for a payload that is not a secure envelope
+	ErrNotSecured = errors.New("Message is not a secure envelope")
+)
+
+//UnknownKeyError is returned when a message names a key id the key ring does not hold
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("Unknown key id '%s'", e.ID)
+}
+
+//KeyNotAcceptedError is returned for a message using a key SecureOptions.AcceptKeys doesn't accept on its topic
+type KeyNotAcceptedError struct {
+	ID    string
+	Topic string
+}
+
+func (e *KeyNotAcceptedError) Error() string {
+	return fmt.Sprintf("Key id '%s' is not accepted on '%s'", e.ID, e.Topic)
+}
+
+//keyAccepted reports whether id is in ids, a nil ids accepting every id
+func keyAccepted(ids []string, id string) bool {
+	if ids == nil {
+		return true
+	}
+	for _, accepted := range ids {
+		if accepted == id {
+			return true
+		}
+	}
+	return false
+}
+
+//PayloadKeys holds encryption and signing keys by id. Several ids can be held at once, so keys can be
+//rotated by adding the new key, switching to it with UseEncryptionKey or UseSigningKey, and removing
+//the old one once nothing signed or encrypted with it is in flight. Per device keys are held under ids
+//naming the device.
+type PayloadKeys struct {
+	lock      sync.RWMutex
+	aead      map[string][]byte
+	hmac      map[string][]byte
+	signers   map[string]ed25519.PrivateKey
+	verifiers map[string]ed25519.PublicKey
+	encryptID string
+	signID    string
+}
+
+//NewPayloadKeys returns an empty key ring
+func NewPayloadKeys() *PayloadKeys {
+	return &PayloadKeys{
+		aead:      map[string][]byte{},
+		hmac:      map[string][]byte{},
+		signers:   map[string]ed25519.PrivateKey{},
+		verifiers: map[string]ed25519.PublicKey{},
+	}
+}
+
+//AddEncryptionKey adds an AES-GCM key of 16, 24 or 32 bytes. The first key added is used for encrypting.
+func (k *PayloadKeys) AddEncryptionKey(id string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("Bad encryption key '%s': %v", id, err)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.aead[id] = append([]byte{}, key...)
+	if k.encryptID == "" {
+		k.encryptID = id
+	}
+	return nil
+}
+
+//AddHMACKey adds a shared signing key. The first signing key added is used for signing.
+func (k *PayloadKeys) AddHMACKey(id string, key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("Bad hmac key '%s': empty", id)
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.hmac[id] = append([]byte{}, key...)
+	if k.signID == "" {
+		k.signID = id
+	}
+	return nil
+}
+
+//AddSigningKey adds an Ed25519 private key, and its public key for verifying. The first signing key added is used for signing.
+func (k *PayloadKeys) AddSigningKey(id string, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("Bad ed25519 private key '%s': %d bytes", id, len(key))
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.signers[id] = key
+	k.verifiers[id] = key.Public().(ed25519.PublicKey)
+	if k.signID == "" {
+		k.signID = id
+	}
+	return nil
+}
+
+//AddVerifyKey adds an Ed25519 public key, for verifying messages signed by its owner
+func (k *PayloadKeys) AddVerifyKey(id string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Bad ed25519 public key '%s': %d bytes", id, len(key))
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.verifiers[id] = key
+	return nil
+}
+
+//UseEncryptionKey makes id the key new messages are encrypted with
+func (k *PayloadKeys) UseEncryptionKey(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.aead[id]; !ok {
+		return &UnknownKeyError{ID: id}
+	}
+	k.encryptID = id
+	return nil
+}
+
+//UseSigningKey makes id the key new messages are signed with
+func (k *PayloadKeys) UseSigningKey(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	_, isHMAC := k.hmac[id]
+	_, isEd := k.signers[id]
+	if !isHMAC && !isEd {
+		return &UnknownKeyError{ID: id}
+	}
+	k.signID = id
+	return nil
+}
+
+//Remove drops every key held under id
+func (k *PayloadKeys) Remove(id string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.aead = withoutBytesKey(k.aead, id)
+	k.hmac = withoutBytesKey(k.hmac, id)
+	signers := map[string]ed25519.PrivateKey{}
+	for kid, key := range k.signers {
+		if kid != id {
+			signers[kid] = key
+		}
+	}
+	k.signers = signers
+	verifiers := map[string]ed25519.PublicKey{}
+	for kid, key := range k.verifiers {
+		if kid != id {
+			verifiers[kid] = key
+		}
+	}
+	k.verifiers = verifiers
+	if k.encryptID == id {
+		k.encryptID = ""
+	}
+	if k.signID == id {
+		k.signID = ""
+	}
+}
+
+func withoutBytesKey(m map[string][]byte, id string) map[string][]byte {
+	rval := make(map[string][]byte, len(m))
+	for kid, key := range m {
+		if kid != id {
+			rval[kid] = key
+		}
+	}
+	return rval
+}
+
+//secureEnvelope is what travels on the wire. The signature covers every other field.
+type secureEnvelope struct {
+	Version   int    `json:"v"`
+	KeyID     string `json:"kid,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Data      []byte `json:"data"`
+	Alg       string `json:"alg,omitempty"`
+	SignKeyID string `json:"sid,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+}
+
+//signed returns the bytes the signature is made over. Every field is length prefixed, so no two
+//different envelopes, like ones splitting the same bytes differently between nonce and data, sign the same.
+func (e *secureEnvelope) signed(topic string) []byte {
+	var b bytes.Buffer
+	version := make([]byte, 8)
+	binary.BigEndian.PutUint64(version, uint64(e.Version))
+	for _, field := range [][]byte{version, []byte(e.KeyID), []byte(e.Alg), []byte(e.SignKeyID), []byte(topic), e.Nonce, e.Data} {
+		writeLengthPrefixed(&b, field)
+	}
+	return b.Bytes()
+}
+
+func writeLengthPrefixed(b *bytes.Buffer, field []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(field)))
+	b.Write(length)
+	b.Write(field)
+}
+
+//SecureOptions controls how a SecureClient protects payloads
+type SecureOptions struct {
+	Keys *PayloadKeys
+	//Encrypt and Sign apply to published messages
+	Encrypt bool
+	Sign    bool
+	//KeysForTopic picks the encryption and signing key ids for a published topic, for example a device's own keys.
+	//Empty ids fall back to the key ring's current keys.
+	KeysForTopic func(topic string) (encryptID, signID string)
+	//AcceptKeys restricts the key ids a message received on topic may be encrypted and signed with, for example
+	//to the keys of the device the topic belongs to. Messages naming another id are rejected with a
+	//*KeyNotAcceptedError. A nil list accepts every key of the ring, and so does leaving AcceptKeys nil.
+	AcceptKeys func(topic string) (encryptIDs, signIDs []string)
+	//BindTopic covers the topic with the signature and encryption, so a message cannot be replayed to
+	//another topic. Messages forwarded to a different topic, by a bridge for example, will then be rejected.
+	BindTopic bool
+	//AllowUnsigned and AllowPlaintext accept received messages that lack a signature or encryption
+	AllowUnsigned  bool
+	AllowPlaintext bool
+	//OnReject is called for received messages that fail verification or decryption. Subscribe requires it.
+	OnReject DecodeErrorHandler
+	//Options applies to the subscriptions made by Subscribe
+	Options SubscribeOptions
+}
+
+//SecureClient encrypts and signs payloads before publishing them, and verifies and decrypts them on receipt
+type SecureClient struct {
+	client MqttClient
+	opts   SecureOptions
+}
+
+//NewSecureClient returns a SecureClient publishing and subscribing through c
+func NewSecureClient(c MqttClient, opts SecureOptions) (*SecureClient, error) {
+	if opts.Keys == nil {
+		return nil, fmt.Errorf("Keys are required")
+	}
+	return &SecureClient{client: c, opts: opts}, nil
+}
+
+//Publish seals payload and publishes it
+func (s *SecureClient) Publish(topic string, payload []byte, qos int) error {
+	data, err := s.Seal(topic, payload)
+	if err != nil {
+		return err
+	}
+	return publish(s.client, topic, data, qos, 0)
+}
+
+//Subscribe passes the opened payload of each message on filter to handler. Messages that fail to open are rejected.
+func (s *SecureClient) Subscribe(filter string, qos int, handler func(topic string, payload []byte)) (*Subscription, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Handler is required")
+	}
+	if s.opts.OnReject == nil {
+		return nil, fmt.Errorf("OnReject is required")
+	}
+	return subscribeWithOptions(s.client, filter, qos, s.opts.Options, func(msg *mqttTypes.Publish) {
+		payload, err := s.Open(msg.Topic.Whole, msg.Payload)
+		if err != nil {
+			s.opts.OnReject(msg, fmt.Errorf("Rejected message on '%s': %v", msg.Topic.Whole, err))
+			return
+		}
+		handler(msg.Topic.Whole, payload)
+	})
+}
+
+//Seal encrypts and signs payload as configured, returning the envelope to publish on topic
+func (s *SecureClient) Seal(topic string, payload []byte) ([]byte, error) {
+	keys := s.opts.Keys
+	encryptID, signID := "", ""
+	if s.opts.KeysForTopic != nil {
+		encryptID, signID = s.opts.KeysForTopic(topic)
+	}
+	keys.lock.RLock()
+	defer keys.lock.RUnlock()
+	if encryptID == "" {
+		encryptID = keys.encryptID
+	}
+	if signID == "" {
+		signID = keys.signID
+	}
+	env := &secureEnvelope{Version: _SECURE_ENVELOPE_VERSION, Data: payload}
+	if s.opts.Encrypt {
+		key, ok := keys.aead[encryptID]
+		if !ok {
+			return nil, &UnknownKeyError{ID: encryptID}
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		env.KeyID = encryptID
+		env.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, env.Nonce); err != nil {
+			return nil, fmt.Errorf("Error making nonce: %v", err)
+		}
+		env.Data = gcm.Seal(nil, env.Nonce, payload, s.additionalData(encryptID, topic))
+	}
+	if s.opts.Sign {
+		env.SignKeyID = signID
+		if key, ok := keys.hmac[signID]; ok {
+			env.Alg = SignHMAC
+			mac := hmac.New(sha256.New, key)
+			mac.Write(env.signed(s.boundTopic(topic)))
+			env.Signature = mac.Sum(nil)
+		} else if key, ok := keys.signers[signID]; ok {
+			env.Alg = SignEd25519
+			env.Signature = ed25519.Sign(key, env.signed(s.boundTopic(topic)))
+		} else {
+			return nil, &UnknownKeyError{ID: signID}
+		}
+	}
+	return json.Marshal(env)
+}
+
+//Open verifies and decrypts an envelope received on topic and returns the original payload
+func (s *SecureClient) Open(topic string, data []byte) ([]byte, error) {
+	env := &secureEnvelope{}
+	if err := json.Unmarshal(data, env); err != nil || env.Version == 0 {
+		return nil, ErrNotSecured
+	}
+	if env.Version != _SECURE_ENVELOPE_VERSION {
+		return nil, fmt.Errorf("Unsupported secure envelope version %d", env.Version)
+	}
+	var encryptIDs, signIDs []string
+	if s.opts.AcceptKeys != nil {
+		encryptIDs, signIDs = s.opts.AcceptKeys(topic)
+	}
+	if env.Alg != "" && !keyAccepted(signIDs, env.SignKeyID) {
+		return nil, &KeyNotAcceptedError{ID: env.SignKeyID, Topic: topic}
+	}
+	if env.KeyID != "" && !keyAccepted(encryptIDs, env.KeyID) {
+		return nil, &KeyNotAcceptedError{ID: env.KeyID, Topic: topic}
+	}
+	keys := s.opts.Keys
+	keys.lock.RLock()
+	defer keys.lock.RUnlock()
+	switch env.Alg {
+	case "":
+		if !s.opts.AllowUnsigned {
+			return nil, ErrUnsigned
+		}
+	case SignHMAC:
+		key, ok := keys.hmac[env.SignKeyID]
+		if !ok {
+			return nil, &UnknownKeyError{ID: env.SignKeyID}
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(env.signed(s.boundTopic(topic)))
+		if !hmac.Equal(mac.Sum(nil), env.Signature) {
+			return nil, ErrBadSignature
+		}
+	case SignEd25519:
+		key, ok := keys.verifiers[env.SignKeyID]
+		if !ok {
+			return nil, &UnknownKeyError{ID: env.SignKeyID}
+		}
+		if !ed25519.Verify(key, env.signed(s.boundTopic(topic)), env.Signature) {
+			return nil, ErrBadSignature
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported signature algorithm '%s'", env.Alg)
+	}
+	if env.KeyID == "" {
+		if !s.opts.AllowPlaintext {
+			return nil, ErrNotEncrypted
+		}
+		return env.Data, nil
+	}
+	key, ok := keys.aead[env.KeyID]
+	if !ok {
+		return nil, &UnknownKeyError{ID: env.KeyID}
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Bad nonce length %d", len(env.Nonce))
+	}
+	payload, err := gcm.Open(nil, env.Nonce, env.Data, s.additionalData(env.KeyID, topic))
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting message: %v", err)
+	}
+	return payload, nil
+}
+
+func (s *SecureClient) boundTopic(topic string) string {
+	if s.opts.BindTopic {
+		return topic
+	}
+	return ""
+}
+
+func (s *SecureClient) additionalData(keyID, topic string) []byte {
+	var b bytes.Buffer
+	writeLengthPrefixed(&b, []byte(keyID))
+	writeLengthPrefixed(&b, []byte(s.boundTopic(topic)))
+	return b.Bytes()
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
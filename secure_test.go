@@ -0,0 +1,198 @@
+package GoSDK
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+)
+
+//securePair returns a sender and a receiver that each hold their own copy of the keys in ids.
+//Keys are derived from their id, so both sides agree on them.
+func securePair(t *testing.T, send, receive SecureOptions, ids ...string) (*SecureClient, *SecureClient) {
+	clients := []*SecureClient{}
+	for _, opts := range []SecureOptions{send, receive} {
+		opts.Keys = NewPayloadKeys()
+		for _, id := range ids {
+			if err := opts.Keys.AddEncryptionKey(id+"-enc", bytes.Repeat([]byte(id[:1]), 32)); err != nil {
+				t.Fatal(err)
+			}
+			if err := opts.Keys.AddHMACKey(id+"-mac", []byte(id+" mac key")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := NewSecureClient(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, s)
+	}
+	return clients[0], clients[1]
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	sender, receiver := securePair(t, SecureOptions{Encrypt: true, Sign: true, BindTopic: true}, SecureOptions{BindTopic: true}, "a")
+	sealed, err := sender.Seal("a/b", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := receiver.Open("a/b", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "hello" {
+		t.Errorf("got %q", payload)
+	}
+	if _, err := receiver.Open("a/c", sealed); err == nil {
+		t.Error("expected a message bound to another topic to be rejected")
+	}
+	if _, err := receiver.Open("a/b", []byte("hello")); err != ErrNotSecured {
+		t.Errorf("got %v, want ErrNotSecured", err)
+	}
+}
+
+func TestSecureRejectsKeysNotAccepted(t *testing.T) {
+	accept := func(topic string) ([]string, []string) {
+		device := splitTopic(topic)[1]
+		return []string{device + "-enc"}, []string{device + "-mac"}
+	}
+	sender, receiver := securePair(t, SecureOptions{Encrypt: true, Sign: true}, SecureOptions{AcceptKeys: accept}, "one", "two")
+
+	//both rings hold the keys of device two, but they are not accepted on the topics of device one
+	if err := sender.opts.Keys.UseEncryptionKey("two-enc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.opts.Keys.UseSigningKey("two-mac"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sender.Seal("devices/one/state", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiver.Open("devices/one/state", sealed)
+	if kerr, ok := err.(*KeyNotAcceptedError); !ok || kerr.ID != "two-mac" {
+		t.Errorf("got %v, want the signing key rejected", err)
+	}
+	if _, err := receiver.Open("devices/two/state", sealed); err != nil {
+		t.Errorf("device two's own topic: %v", err)
+	}
+
+	//a message signed with an accepted key but encrypted with another is rejected too
+	sender.opts.Keys.UseSigningKey("one-mac")
+	sealed, err = sender.Seal("devices/one/state", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiver.Open("devices/one/state", sealed)
+	if kerr, ok := err.(*KeyNotAcceptedError); !ok || kerr.ID != "two-enc" {
+		t.Errorf("got %v, want the encryption key rejected", err)
+	}
+}
+
+func TestSecureRejectsRemovedKey(t *testing.T) {
+	sender, receiver := securePair(t, SecureOptions{Encrypt: true, Sign: true}, SecureOptions{}, "old", "new")
+	before, err := sender.Seal("t", []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//rotate: switch to the new keys, then retire the old ones on both sides
+	sender.opts.Keys.UseEncryptionKey("new-enc")
+	sender.opts.Keys.UseSigningKey("new-mac")
+	for _, s := range []*SecureClient{sender, receiver} {
+		s.opts.Keys.Remove("old-enc")
+		s.opts.Keys.Remove("old-mac")
+	}
+	after, err := sender.Seal("t", []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := receiver.Open("t", after); err != nil || string(payload) != "after" {
+		t.Errorf("got %q, %v", payload, err)
+	}
+	_, err = receiver.Open("t", before)
+	if kerr, ok := err.(*UnknownKeyError); !ok || kerr.ID != "old-mac" {
+		t.Errorf("got %v, want the removed key reported", err)
+	}
+}
+
+func TestSecureRequiresSignatureAndEncryption(t *testing.T) {
+	sender, receiver := securePair(t, SecureOptions{Encrypt: true}, SecureOptions{}, "k")
+	unsigned, err := sender.Seal("t", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open("t", unsigned); err != ErrUnsigned {
+		t.Errorf("got %v, want ErrUnsigned", err)
+	}
+	receiver.opts.AllowUnsigned = true
+	if payload, err := receiver.Open("t", unsigned); err != nil || string(payload) != "x" {
+		t.Errorf("with AllowUnsigned got %q, %v", payload, err)
+	}
+
+	sender.opts = SecureOptions{Keys: sender.opts.Keys, Sign: true}
+	plain, err := sender.Seal("t", []byte("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open("t", plain); err != ErrNotEncrypted {
+		t.Errorf("got %v, want ErrNotEncrypted", err)
+	}
+	receiver.opts.AllowPlaintext = true
+	if payload, err := receiver.Open("t", plain); err != nil || string(payload) != "y" {
+		t.Errorf("with AllowPlaintext got %q, %v", payload, err)
+	}
+}
+
+//moving bytes between the nonce and the data must break the signature
+func TestSecureRejectsTamperedNonceDataSplit(t *testing.T) {
+	sender, receiver := securePair(t, SecureOptions{Sign: true}, SecureOptions{AllowPlaintext: true}, "k")
+	tamper := func(sealed []byte, nonce, data string) []byte {
+		env := &secureEnvelope{}
+		if err := json.Unmarshal(sealed, env); err != nil {
+			t.Fatal(err)
+		}
+		env.Nonce = []byte(nonce)
+		env.Data = []byte(data)
+		tampered, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tampered
+	}
+	sealed, err := sender.Seal("t", []byte("x\ny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open("t", tamper(sealed, "\nx", "y")); err != ErrBadSignature {
+		t.Errorf("got %v, want ErrBadSignature", err)
+	}
+
+	//the same for ed25519 signatures, the receiver holding only the public key
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.opts.Keys.AddSigningKey("ed", priv)
+	receiver.opts.Keys.AddVerifyKey("ed", pub)
+	if err := sender.opts.Keys.UseSigningKey("ed"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err = sender.Seal("t", []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := receiver.Open("t", sealed); err != nil || string(payload) != "ab" {
+		t.Errorf("ed25519: got %q, %v", payload, err)
+	}
+	if _, err := receiver.Open("t", tamper(sealed, "a", "b")); err != ErrBadSignature {
+		t.Errorf("ed25519: got %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSecureSignedFieldsAreUnambiguous(t *testing.T) {
+	a := &secureEnvelope{Version: 1, KeyID: "k\n", Alg: SignHMAC, Nonce: []byte("a\nb"), Data: []byte("c")}
+	b := &secureEnvelope{Version: 1, KeyID: "k", Alg: "\n" + SignHMAC, Nonce: []byte("a"), Data: []byte("b\nc")}
+	if bytes.Equal(a.signed("t"), b.signed("t")) {
+		t.Error("different envelopes sign the same bytes")
+	}
+}
@@ -0,0 +1,249 @@
+package GoSDK
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+	"github.com/clearblade/paho.mqtt.golang/packets"
+)
+
+//MqttSessionOptions controls what survives a disconnect or a restart of the process
+type MqttSessionOptions struct {
+	//Persistent connects without a clean session, so the broker keeps the client's subscriptions and
+	//queues its qos 1 and 2 messages while it is away. It needs the same client id on every connect.
+	//DeviceClient.InitializeMQTT uses StableClientID when it is passed an empty client id.
+	Persistent bool
+	//StoreDir keeps in-flight qos 1 and 2 messages on disk, in a directory per client id, instead of in memory.
+	//Publishes that were not acknowledged when the process stopped are sent again on the next connect, as new
+	//messages with new message ids. Delivery is at least once: the broker may already have had one, and qos 2
+	//publishes lose their exactly once guarantee. A qos 2 publish whose release was in flight is not sent
+	//again, since the broker had received it.
+	//Since the client doesn't resume its session after an automatic reconnect, publishes in flight when the
+	//connection drops are not sent again: their tokens fail with an error and the caller has to publish them again.
+	StoreDir string
+}
+
+//mqttConnectOptions gathers the connection settings made on a client before InitializeMQTT
+type mqttConnectOptions struct {
+	webSocket *WebSocketOptions
+	version   uint
+	session   *MqttSessionOptions
+}
+
+//SetMqttSession sets the session options used by later calls to InitializeMQTT. Passing nil restores clean sessions.
+func (b *client) SetMqttSession(opts *MqttSessionOptions) {
+	b.session = opts
+}
+
+func (b *client) connectOptions() *mqttConnectOptions {
+	return &mqttConnectOptions{
+		webSocket: b.webSocket,
+		version:   b.mqttVersion,
+		session:   b.session,
+	}
+}
+
+//StableClientID derives a client id from the system key and device name, so a device reconnects to the same session
+func (d *DeviceClient) StableClientID() string {
+	sum := sha256.Sum256([]byte(d.SystemKey + ":" + d.DeviceName))
+	return fmt.Sprintf("%X", sum[:10])
+}
+
+func (d *DeviceClient) sessionClientID(clientid string) string {
+	if clientid == "" && d.session != nil && d.session.Persistent {
+		return d.StableClientID()
+	}
+	return clientid
+}
+
+//apply sets the broker, protocol version and session on o. The returned closer shuts down the websocket bridge, if any.
+//Sessions are left out for the auth client, which only lives for one exchange.
+func (conn *mqttConnectOptions) apply(o *mqtt.ClientOptions, address string, ssl *tls.Config, clientid string, auth bool) (io.Closer, *unsentPublishes, error) {
+	if conn == nil {
+		conn = &mqttConnectOptions{}
+	}
+	bridge, err := setBroker(o, address, ssl, conn.webSocket, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.version != 0 {
+		o.SetProtocolVersion(conn.version)
+	}
+	if auth || conn.session == nil {
+		return bridge, nil, nil
+	}
+	o.SetCleanSession(!conn.session.Persistent)
+	if conn.session.StoreDir == "" {
+		return bridge, nil, nil
+	}
+	dir := filepath.Join(conn.session.StoreDir, storeDirName(clientid))
+	unsent, err := takeUnsentPublishes(dir)
+	if err != nil {
+		if bridge != nil {
+			bridge.Close()
+		}
+		return nil, nil, err
+	}
+	o.SetStore(mqtt.NewFileStore(dir))
+	return bridge, unsent, nil
+}
+
+//storeDirName makes a client id safe to use as a directory name. Dots are replaced, which leaves names
+//ending in ".unsent" free for the pending stores.
+func storeDirName(clientid string) string {
+	if clientid == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == '.' {
+			return '_'
+		}
+		return r
+	}, clientid)
+}
+
+//unsentPublishes are the publishes a previous process left unacknowledged, kept in a pending store
+//until the broker acknowledges them again
+type unsentPublishes struct {
+	store *mqtt.FileStore
+	keys  []string
+	pubs  []*packets.PublishPacket
+}
+
+//takeUnsentPublishes moves the publishes a previous process left unacknowledged in the store at dir into
+//a pending store next to it, empties the store, and returns everything pending. They have to leave the client's
+//store before it connects because new message ids would reuse their keys. Each one is written to the pending
+//store before it is deleted from the client's, so a crash part way through can only send a message twice.
+func takeUnsentPublishes(dir string) (*unsentPublishes, error) {
+	pendingDir := dir + ".unsent"
+	for _, d := range []string{dir, pendingDir} {
+		if err := os.MkdirAll(d, 0770); err != nil {
+			return nil, fmt.Errorf("Error creating mqtt store: %v", err)
+		}
+	}
+	pending := mqtt.NewFileStore(pendingDir)
+	pending.Open()
+	keys := pendingKeys(pending)
+	next := int64(1)
+	if len(keys) > 0 {
+		next = pendingSeq(keys[len(keys)-1]) + 1
+	}
+
+	store := mqtt.NewFileStore(dir)
+	store.Open()
+	for _, key := range outboundKeys(dir, store.All()) {
+		pub, ok := store.Get(key).(*packets.PublishPacket)
+		if !ok {
+			continue
+		}
+		pending.Put(fmt.Sprintf("p.%d", next), pub)
+		next++
+		store.Del(key)
+	}
+	//what is left are qos 2 releases and incoming qos 2 messages of the previous connection. The library doesn't
+	//resume sessions, so nothing would finish them, and new message ids would find them under their keys.
+	for _, key := range store.All() {
+		store.Del(key)
+	}
+	store.Close()
+
+	unsent := &unsentPublishes{store: pending}
+	for _, key := range pendingKeys(pending) {
+		pub, ok := pending.Get(key).(*packets.PublishPacket)
+		if !ok {
+			pending.Del(key)
+			continue
+		}
+		unsent.keys = append(unsent.keys, key)
+		unsent.pubs = append(unsent.pubs, pub)
+	}
+	return unsent, nil
+}
+
+//outboundKeys returns the "o.<message id>" keys in the order they were written. The library hands out the
+//lowest free message id, so the ids themselves say nothing about the order once any has been reused.
+func outboundKeys(dir string, keys []string) []string {
+	type entry struct {
+		key  string
+		id   int64
+		when time.Time
+	}
+	var entries []entry
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "o.") {
+			continue
+		}
+		id, err := strconv.ParseInt(key[2:], 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, key+".msg"))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{key: key, id: id, when: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].when.Equal(entries[j].when) {
+			return entries[i].when.Before(entries[j].when)
+		}
+		return entries[i].id < entries[j].id
+	})
+	rval := make([]string, len(entries))
+	for i, e := range entries {
+		rval[i] = e.key
+	}
+	return rval
+}
+
+//pendingKeys returns the "p.<sequence>" keys of the pending store in sequence order
+func pendingKeys(pending *mqtt.FileStore) []string {
+	var keys []string
+	for _, key := range pending.All() {
+		if pendingSeq(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return pendingSeq(keys[i]) < pendingSeq(keys[j])
+	})
+	return keys
+}
+
+func pendingSeq(key string) int64 {
+	if !strings.HasPrefix(key, "p.") {
+		return 0
+	}
+	seq, err := strconv.ParseInt(key[2:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+//resend publishes the messages left over by a previous process with their original qos and retain flag.
+//They go out as new messages, without the dup flag, since the library stores them again under new message ids.
+//Each is deleted from the pending store once the broker has acknowledged it. One that fails is kept and sent
+//again by the next InitializeMQTT.
+func (u *unsentPublishes) resend(c mqtt.Client) {
+	if u == nil {
+		return
+	}
+	for i, pub := range u.pubs {
+		token := c.Publish(pub.TopicName, pub.Qos, pub.Retain, pub.Payload)
+		go func(key string, token mqtt.Token) {
+			if token.Wait() && token.Error() == nil {
+				u.store.Del(key)
+			}
+		}(u.keys[i], token)
+	}
+}
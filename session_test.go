@@ -0,0 +1,162 @@
+package GoSDK
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+	"github.com/clearblade/paho.mqtt.golang/packets"
+)
+
+//fakeMqttBroker accepts 3.1.1 connections and passes on every publish it gets. It only acks them with ack set.
+type fakeMqttBroker struct {
+	ln        net.Listener
+	ack       bool
+	publishes chan *packets.PublishPacket
+	lock      sync.Mutex
+	conns     []net.Conn
+}
+
+func newFakeMqttBroker(t *testing.T, ack bool) *fakeMqttBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeMqttBroker{ln: ln, ack: ack, publishes: make(chan *packets.PublishPacket, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.conns = append(b.conns, conn)
+			b.lock.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeMqttBroker) serve(conn net.Conn) {
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.PublishPacket:
+			b.publishes <- p
+			if b.ack && p.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				reply = puback
+			}
+		}
+		if reply != nil {
+			reply.Write(conn)
+		}
+	}
+}
+
+func (b *fakeMqttBroker) next(t *testing.T) *packets.PublishPacket {
+	select {
+	case pub := <-b.publishes:
+		return pub
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a publish")
+	}
+	return nil
+}
+
+func (b *fakeMqttBroker) close() {
+	b.ln.Close()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+//storeKeys lists the keys of the file store at dir
+func storeKeys(t *testing.T, dir string) []string {
+	store := mqtt.NewFileStore(dir)
+	store.Open()
+	defer store.Close()
+	return store.All()
+}
+
+//a publish the broker never acknowledged is sent again by the next process, and what is left of a qos 2
+//exchange is cleared before new message ids can reuse its keys
+func TestSessionResendsAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	session := &MqttSessionOptions{Persistent: true, StoreDir: dir}
+
+	first := newFakeMqttBroker(t, false)
+	u := NewUserClientWithServiceAccountAndAddrs("", first.ln.Addr().String(), "key", "secret", "user@example.com", "token")
+	u.SetMqttSession(session)
+	if err := u.InitializeMQTT("cid", "", 2, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	u.MQTTClient.Publish("a/b", 1, true, []byte("in flight"))
+	if pub := first.next(t); string(pub.Payload) != "in flight" {
+		t.Fatalf("broker got %q", pub.Payload)
+	}
+	//the process stops with the publish unacknowledged
+	u.MQTTClient.Disconnect(0)
+	first.close()
+
+	storeDir := filepath.Join(dir, "cid")
+	store := mqtt.NewFileStore(storeDir)
+	store.Open()
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 9
+	store.Put("o.9", pubrel)
+	incoming := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	incoming.Qos, incoming.MessageID, incoming.TopicName = 2, 3, "c/d"
+	store.Put("i.3", incoming)
+	store.Close()
+
+	second := newFakeMqttBroker(t, true)
+	defer second.close()
+	u.MqttAddr = second.ln.Addr().String()
+	if err := u.InitializeMQTT("cid", "", 2, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer u.MQTTClient.Disconnect(0)
+	pub := second.next(t)
+	if pub.TopicName != "a/b" || string(pub.Payload) != "in flight" || pub.Qos != 1 || !pub.Retain {
+		t.Errorf("resent %+v", pub)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pending, left := storeKeys(t, storeDir+".unsent"), storeKeys(t, storeDir)
+		if len(pending) == 0 && len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending %v and store %v left after the ack", pending, left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case pub := <-second.publishes:
+		t.Errorf("sent %+v as well", pub)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,471 @@
+package GoSDK
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+)
+
+const (
+	_DEFAULT_SHADOW_COLUMN = "shadow"
+	_DEFAULT_SHADOW_PREFIX = "shadow"
+)
+
+//ShadowOptions configures both sides of a device shadow
+type ShadowOptions struct {
+	SystemKey string
+	//Column is the string column of the devices table the shadow document is stored in. It must be added
+	//to the table before use. Defaults to "shadow".
+	Column string
+	//TopicPrefix is the first level of the shadow topics, <prefix>/<device>/delta, reported, accepted and rejected.
+	//Defaults to "shadow".
+	TopicPrefix string
+	Qos         int
+}
+
+func (o *ShadowOptions) defaults() {
+	if o.Column == "" {
+		o.Column = _DEFAULT_SHADOW_COLUMN
+	}
+	if o.TopicPrefix == "" {
+		o.TopicPrefix = _DEFAULT_SHADOW_PREFIX
+	}
+}
+
+func (o *ShadowOptions) topic(device, kind string) string {
+	return o.TopicPrefix + "/" + device + "/" + kind
+}
+
+//ShadowDocument is the desired and reported state of a device. Version goes up by one with every change to either.
+type ShadowDocument struct {
+	Desired  map[string]interface{} `json:"desired"`
+	Reported map[string]interface{} `json:"reported"`
+	Version  int64                  `json:"version"`
+	Updated  time.Time              `json:"updated"`
+}
+
+//Delta returns the desired values that differ from the reported ones
+func (s *ShadowDocument) Delta() map[string]interface{} {
+	delta := map[string]interface{}{}
+	for k, want := range s.Desired {
+		if have, ok := s.Reported[k]; !ok || !sameJSON(want, have) {
+			delta[k] = want
+		}
+	}
+	return delta
+}
+
+//ShadowConflictError is returned when an update was based on an older version of the shadow than the stored one
+type ShadowConflictError struct {
+	Device   string
+	Expected int64
+	Current  int64
+}
+
+func (e *ShadowConflictError) Error() string {
+	return fmt.Sprintf("Shadow of device '%s' is at version %d, update was based on version %d", e.Device, e.Current, e.Expected)
+}
+
+//shadowMessage is the payload of every shadow topic
+type shadowMessage struct {
+	Version int64                  `json:"version"`
+	State   map[string]interface{} `json:"state,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+//deviceStore is the part of the user, device and developer clients a shadow is stored through
+type deviceStore interface {
+	GetDevice(systemKey, name string) (map[string]interface{}, error)
+	UpdateDevice(systemKey, name string, data map[string]interface{}) (map[string]interface{}, error)
+}
+
+func loadShadow(store deviceStore, opts *ShadowOptions, device string) (*ShadowDocument, error) {
+	row, err := store.GetDevice(opts.SystemKey, device)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting device '%s': %v", device, err)
+	}
+	doc := &ShadowDocument{}
+	switch v := row[opts.Column].(type) {
+	case nil:
+	case string:
+		if v != "" {
+			if err := json.Unmarshal([]byte(v), doc); err != nil {
+				return nil, fmt.Errorf("Bad shadow for device '%s': %v", device, err)
+			}
+		}
+	default:
+		b, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(b, doc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad shadow for device '%s': %v", device, err)
+		}
+	}
+	if doc.Desired == nil {
+		doc.Desired = map[string]interface{}{}
+	}
+	if doc.Reported == nil {
+		doc.Reported = map[string]interface{}{}
+	}
+	return doc, nil
+}
+
+func saveShadow(store deviceStore, opts *ShadowOptions, device string, doc *ShadowDocument) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if _, err := store.UpdateDevice(opts.SystemKey, device, map[string]interface{}{opts.Column: string(b)}); err != nil {
+		return fmt.Errorf("Error saving shadow of device '%s': %v", device, err)
+	}
+	return nil
+}
+
+//mergeState applies patch to state. Nested objects are merged, and nil values remove their key.
+func mergeState(state, patch map[string]interface{}) map[string]interface{} {
+	rval := make(map[string]interface{}, len(state)+len(patch))
+	for k, v := range state {
+		if _, patched := patch[k]; !patched {
+			rval[k] = v
+		}
+	}
+	for k, v := range patch {
+		if v == nil {
+			continue
+		}
+		sub, isMap := v.(map[string]interface{})
+		old, wasMap := state[k].(map[string]interface{})
+		if isMap && wasMap {
+			rval[k] = mergeState(old, sub)
+			continue
+		}
+		rval[k] = v
+	}
+	return rval
+}
+
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+//ShadowManager keeps the shadows of devices on the service side: it stores desired state changes, publishes
+//the resulting deltas to the devices, and applies the states they report.
+//The devices table has no conditional update, so versions are checked by loading a shadow and saving it while
+//holding the manager's lock. That only orders the changes made through one manager: two managers writing the
+//same device, in one process or several, can overwrite each other's changes.
+type ShadowManager struct {
+	store  deviceStore
+	client MqttClient
+	opts   ShadowOptions
+	lock   sync.Mutex
+	sub    *Subscription
+	//deltaSent holds, by device, the desired state as it was when the last delta was sent
+	deltaSent map[string]map[string]interface{}
+	//OnReport is called after a device's reported state has been stored
+	OnReport func(device string, doc *ShadowDocument)
+	//OnError is called with errors handling reports. They are ignored if it is nil.
+	OnError func(error)
+}
+
+//DeviceShadows returns a manager of device shadows stored through the client, listening for reports on its mqtt connection
+func (u *UserClient) DeviceShadows(opts ShadowOptions) (*ShadowManager, error) {
+	if opts.SystemKey == "" {
+		opts.SystemKey = u.SystemKey
+	}
+	return newShadowManager(u, u.guardedMqtt(), opts)
+}
+
+//DeviceShadows returns a manager of device shadows stored through the client, listening for reports on its mqtt connection
+func (d *DevClient) DeviceShadows(opts ShadowOptions) (*ShadowManager, error) {
+	return newShadowManager(d, d.MQTTClient, opts)
+}
+
+func newShadowManager(store deviceStore, mqc MqttClient, opts ShadowOptions) (*ShadowManager, error) {
+	if opts.SystemKey == "" {
+		return nil, fmt.Errorf("SystemKey is required")
+	}
+	opts.defaults()
+	m := &ShadowManager{store: store, client: mqc, opts: opts, deltaSent: map[string]map[string]interface{}{}}
+	sub, err := subscribeWithOptions(mqc, opts.topic("+", "reported"), opts.Qos, SubscribeOptions{}, m.reported)
+	if err != nil {
+		return nil, err
+	}
+	m.sub = sub
+	return m, nil
+}
+
+//Get returns the stored shadow of device
+func (m *ShadowManager) Get(device string) (*ShadowDocument, error) {
+	return loadShadow(m.store, &m.opts, device)
+}
+
+//UpdateDesired merges patch into the desired state of device and publishes the new delta to it.
+//If version is not zero and the shadow has moved past it, a *ShadowConflictError is returned and nothing changes.
+func (m *ShadowManager) UpdateDesired(device string, patch map[string]interface{}, version int64) (*ShadowDocument, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	doc, err := loadShadow(m.store, &m.opts, device)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && version != doc.Version {
+		return nil, &ShadowConflictError{Device: device, Expected: version, Current: doc.Version}
+	}
+	doc.Desired = mergeState(doc.Desired, patch)
+	doc.Version++
+	doc.Updated = time.Now()
+	if err := saveShadow(m.store, &m.opts, device, doc); err != nil {
+		return nil, err
+	}
+	m.deltaSent[device] = doc.Desired
+	return doc, m.send(device, "delta", &shadowMessage{Version: doc.Version, State: doc.Delta()})
+}
+
+//Close stops listening for reports
+func (m *ShadowManager) Close() error {
+	return m.sub.Unsubscribe()
+}
+
+func (m *ShadowManager) reported(msg *mqttTypes.Publish) {
+	levels := splitTopic(msg.Topic.Whole)
+	if len(levels) < 3 {
+		return
+	}
+	device := levels[len(levels)-2]
+	report := &shadowMessage{}
+	if err := json.Unmarshal(msg.Payload, report); err != nil {
+		m.fail(fmt.Errorf("Bad shadow report from device '%s': %v", device, err))
+		return
+	}
+	doc, resend, err := m.applyReport(device, report)
+	if err != nil {
+		if conflict, ok := err.(*ShadowConflictError); ok {
+			m.send(device, "rejected", &shadowMessage{Version: conflict.Current, Error: conflict.Error()})
+			return
+		}
+		m.send(device, "rejected", &shadowMessage{Version: report.Version, Error: err.Error()})
+		m.fail(err)
+		return
+	}
+	m.send(device, "accepted", &shadowMessage{Version: doc.Version})
+	if resend {
+		m.send(device, "delta", &shadowMessage{Version: doc.Version, State: doc.Delta()})
+	}
+	if m.OnReport != nil {
+		m.OnReport(device, doc)
+	}
+}
+
+//applyReport stores a report and says whether the delta left over should be sent again. It is only when desired
+//state changed since the last delta the device was sent, or none was sent since the manager started.
+//A device that settles on other values than desired, or leaves keys out of its report, isn't sent the same
+//delta again, which would have it apply and report the same values over and over. It can ask for it with Sync.
+func (m *ShadowManager) applyReport(device string, report *shadowMessage) (*ShadowDocument, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	doc, err := loadShadow(m.store, &m.opts, device)
+	if err != nil {
+		return nil, false, err
+	}
+	if report.Version != doc.Version {
+		return nil, false, &ShadowConflictError{Device: device, Expected: report.Version, Current: doc.Version}
+	}
+	doc.Reported = mergeState(doc.Reported, report.State)
+	doc.Version++
+	doc.Updated = time.Now()
+	if err := saveShadow(m.store, &m.opts, device, doc); err != nil {
+		return nil, false, err
+	}
+	delta := doc.Delta()
+	if len(delta) == 0 {
+		return doc, false, nil
+	}
+	sent, ok := m.deltaSent[device]
+	resend := !ok || !sameJSON(sent, doc.Desired)
+	if resend {
+		m.deltaSent[device] = doc.Desired
+	}
+	return doc, resend, nil
+}
+
+func (m *ShadowManager) send(device, kind string, msg *shadowMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return publish(m.client, m.opts.topic(device, kind), b, m.opts.Qos, 0)
+}
+
+func (m *ShadowManager) fail(err error) {
+	if m.OnError != nil {
+		m.OnError(err)
+	}
+}
+
+//ShadowDeltaHandler applies desired state changes on the device. It returns the state actually applied,
+//which is reported back. Returning an error reports nothing, and the delta is offered again on the next Sync.
+type ShadowDeltaHandler func(delta map[string]interface{}) (map[string]interface{}, error)
+
+//DeviceShadow is the device side of a shadow. It passes desired state changes to a handler and reports state.
+type DeviceShadow struct {
+	client  *DeviceClient
+	opts    ShadowOptions
+	handler ShadowDeltaHandler
+	lock    sync.Mutex
+	version int64
+	subs    []*Subscription
+	//OnError is called with errors applying deltas and with rejected reports. They are ignored if it is nil.
+	OnError func(error)
+}
+
+//Shadow follows the device's shadow: handler is called with every delta, including the one pending when
+//Shadow is called. A report rejected because the shadow moved on triggers a Sync.
+func (d *DeviceClient) Shadow(opts ShadowOptions, handler ShadowDeltaHandler) (*DeviceShadow, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("Handler is required")
+	}
+	if opts.SystemKey == "" {
+		opts.SystemKey = d.SystemKey
+	}
+	opts.defaults()
+	s := &DeviceShadow{client: d, opts: opts, handler: handler}
+	handlers := map[string]MessageHandler{
+		"delta":    s.delta,
+		"accepted": s.accepted,
+		"rejected": s.rejected,
+	}
+	for _, kind := range []string{"delta", "accepted", "rejected"} {
+		sub, err := subscribeWithOptions(d.guardedMqtt(), opts.topic(d.DeviceName, kind), opts.Qos, SubscribeOptions{}, handlers[kind])
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.subs = append(s.subs, sub)
+	}
+	if err := s.Sync(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+//Version returns the last shadow version the device knows of
+func (s *DeviceShadow) Version() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+//Sync reads the stored shadow and applies its delta, if any
+func (s *DeviceShadow) Sync() error {
+	doc, err := loadShadow(s.client, &s.opts, s.client.DeviceName)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.version = doc.Version
+	s.lock.Unlock()
+	delta := doc.Delta()
+	if len(delta) == 0 {
+		return nil
+	}
+	return s.apply(delta, doc.Version)
+}
+
+//Report publishes state as the device's reported state, based on the last version the device knows of.
+//If the shadow has changed since, the report is rejected, OnError is called and the shadow is synced. The report is not resent.
+func (s *DeviceShadow) Report(state map[string]interface{}) error {
+	return s.report(state, s.Version())
+}
+
+//Close stops following the shadow
+func (s *DeviceShadow) Close() error {
+	var firstErr error
+	for _, sub := range s.subs {
+		if err := sub.Unsubscribe(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.subs = nil
+	return firstErr
+}
+
+func (s *DeviceShadow) report(state map[string]interface{}, version int64) error {
+	b, err := json.Marshal(&shadowMessage{Version: version, State: state})
+	if err != nil {
+		return err
+	}
+	return publish(s.client.guardedMqtt(), s.opts.topic(s.client.DeviceName, "reported"), b, s.opts.Qos, 0)
+}
+
+func (s *DeviceShadow) apply(delta map[string]interface{}, version int64) error {
+	applied, err := s.handler(delta)
+	if err != nil {
+		return fmt.Errorf("Error applying shadow delta: %v", err)
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+	return s.report(applied, version)
+}
+
+func (s *DeviceShadow) delta(msg *mqttTypes.Publish) {
+	m := &shadowMessage{}
+	if err := json.Unmarshal(msg.Payload, m); err != nil {
+		s.fail(fmt.Errorf("Bad shadow delta: %v", err))
+		return
+	}
+	s.lock.Lock()
+	if m.Version < s.version {
+		//an older delta delivered late, the newer one supersedes it
+		s.lock.Unlock()
+		return
+	}
+	s.version = m.Version
+	s.lock.Unlock()
+	if len(m.State) == 0 {
+		return
+	}
+	if err := s.apply(m.State, m.Version); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *DeviceShadow) accepted(msg *mqttTypes.Publish) {
+	m := &shadowMessage{}
+	if err := json.Unmarshal(msg.Payload, m); err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if m.Version > s.version {
+		s.version = m.Version
+	}
+}
+
+func (s *DeviceShadow) rejected(msg *mqttTypes.Publish) {
+	m := &shadowMessage{}
+	if err := json.Unmarshal(msg.Payload, m); err != nil {
+		return
+	}
+	s.fail(fmt.Errorf("Shadow report rejected: %s", m.Error))
+	//the shadow moved on while the report was in flight, catch up with it
+	go func() {
+		if err := s.Sync(); err != nil {
+			s.fail(err)
+		}
+	}()
+}
+
+func (s *DeviceShadow) fail(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
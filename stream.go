@@ -0,0 +1,281 @@
+package GoSDK
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+//RowIterator walks the rows of a response body one element at a time, without reading the
+//whole body into memory. It understands bodies that are a bare JSON array of rows, and bodies that are
+//an object holding the rows under a "DATA" key (as GetData returns). The other keys of such an object,
+//like "TOTAL" and "NEXTPAGEURL", are collected in Meta; keys that follow "DATA" in the body are only
+//available once Next has returned false.
+type RowIterator struct {
+	Meta    map[string]interface{}
+	body    io.ReadCloser
+	dec     *json.Decoder
+	row     map[string]interface{}
+	err     error
+	inArray bool
+	inObj   bool
+	done    bool
+}
+
+//RowHandler is called for each row streamed from a response. Returning an error stops the stream.
+type RowHandler func(row map[string]interface{}) error
+
+//GetDataIterator performs a query against a collection like GetData, but returns an iterator over the rows
+//instead of the decoded response. The iterator must be closed when the caller is done with it.
+func (u *UserClient) GetDataIterator(collection_id string, query *Query) (*RowIterator, error) {
+	return getDataIterator(u, collection_id, query)
+}
+
+//GetDataIterator performs a query against a collection like GetData, but returns an iterator over the rows
+//instead of the decoded response. The iterator must be closed when the caller is done with it.
+func (d *DeviceClient) GetDataIterator(collection_id string, query *Query) (*RowIterator, error) {
+	return getDataIterator(d, collection_id, query)
+}
+
+//GetDataIterator performs a query against a collection like GetData, but returns an iterator over the rows
+//instead of the decoded response. The iterator must be closed when the caller is done with it.
+func (d *DevClient) GetDataIterator(collection_id string, query *Query) (*RowIterator, error) {
+	return getDataIterator(d, collection_id, query)
+}
+
+//GetDataStream performs a query against a collection and hands each row to fn as it is decoded
+func (u *UserClient) GetDataStream(collection_id string, query *Query, fn RowHandler) error {
+	it, err := getDataIterator(u, collection_id, query)
+	if err != nil {
+		return err
+	}
+	return streamRows(it, fn)
+}
+
+//GetDataStream performs a query against a collection and hands each row to fn as it is decoded
+func (d *DeviceClient) GetDataStream(collection_id string, query *Query, fn RowHandler) error {
+	it, err := getDataIterator(d, collection_id, query)
+	if err != nil {
+		return err
+	}
+	return streamRows(it, fn)
+}
+
+//GetDataStream performs a query against a collection and hands each row to fn as it is decoded
+func (d *DevClient) GetDataStream(collection_id string, query *Query, fn RowHandler) error {
+	it, err := getDataIterator(d, collection_id, query)
+	if err != nil {
+		return err
+	}
+	return streamRows(it, fn)
+}
+
+//MessageHistoryIterator returns an iterator over the message history of a system.
+//The iterator must be closed when the caller is done with it.
+func (d *DevClient) MessageHistoryIterator(systemKey string) (*RowIterator, error) {
+	return getRowIterator(d, _MH_PREAMBLE+systemKey, nil)
+}
+
+//MessageHistoryStream hands each message history entry of a system to fn as it is decoded
+func (d *DevClient) MessageHistoryStream(systemKey string, fn RowHandler) error {
+	it, err := d.MessageHistoryIterator(systemKey)
+	if err != nil {
+		return err
+	}
+	return streamRows(it, fn)
+}
+
+func getDataIterator(c cbClient, collection_id string, query *Query) (*RowIterator, error) {
+	qry, err := createQueryMap(query)
+	if err != nil {
+		return nil, err
+	}
+	it, err := getRowIterator(c, _DATA_PREAMBLE+collection_id, qry)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting data: %v", err)
+	}
+	return it, nil
+}
+
+func getRowIterator(c cbClient, endpoint string, query map[string]string) (*RowIterator, error) {
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRaw(c, &CbReq{
+		Body:        nil,
+		Method:      "GET",
+		Endpoint:    endpoint,
+		QueryString: query_to_string(query),
+	}, creds)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s", string(body))
+	}
+	return newRowIterator(c, resp.Body), nil
+}
+
+func newRowIterator(c cbClient, body io.ReadCloser) *RowIterator {
+	return &RowIterator{
+		Meta: map[string]interface{}{},
+		body: body,
+		dec:  newDecoder(c, json.NewDecoder(body)),
+	}
+}
+
+//streamRows drains the iterator into fn and closes it
+func streamRows(it *RowIterator, fn RowHandler) error {
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.Row()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+//Next advances the iterator to the next row. It returns false once the rows are exhausted or an error occurs.
+func (it *RowIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if !it.inArray {
+		if err := it.start(); err != nil {
+			return it.fail(err)
+		}
+		if it.done {
+			return false
+		}
+	}
+	if !it.dec.More() {
+		if err := it.finish(); err != nil {
+			return it.fail(err)
+		}
+		it.done = true
+		return false
+	}
+	row := map[string]interface{}{}
+	if err := it.dec.Decode(&row); err != nil {
+		return it.fail(fmt.Errorf("Error decoding row: %v", err))
+	}
+	it.row = row
+	return true
+}
+
+//Row returns the row the iterator is positioned on
+func (it *RowIterator) Row() map[string]interface{} {
+	return it.row
+}
+
+//Err returns the error, if any, that stopped the iteration
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+//Close releases the underlying response body
+func (it *RowIterator) Close() error {
+	it.done = true
+	return it.body.Close()
+}
+
+func (it *RowIterator) fail(err error) bool {
+	it.err = err
+	it.done = true
+	it.row = nil
+	return false
+}
+
+//start positions the decoder at the first element of the row array
+func (it *RowIterator) start() error {
+	tok, err := it.dec.Token()
+	if err != nil {
+		return fmt.Errorf("Error reading response: %v", err)
+	}
+	switch tok {
+	case json.Delim('['):
+		it.inArray = true
+		return nil
+	case json.Delim('{'):
+		it.inObj = true
+	default:
+		return fmt.Errorf("Expected a list or an object, got %v", tok)
+	}
+	for it.dec.More() {
+		key, err := it.readKey()
+		if err != nil {
+			return err
+		}
+		if key == "DATA" {
+			tok, err := it.dec.Token()
+			if err != nil {
+				return fmt.Errorf("Error reading response: %v", err)
+			}
+			if tok == nil {
+				//a null DATA is an empty result
+				it.done = true
+				return it.readRest()
+			}
+			if tok != json.Delim('[') {
+				return fmt.Errorf("Expected DATA to be a list, got %v", tok)
+			}
+			it.inArray = true
+			return nil
+		}
+		if err := it.readMeta(key); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("No DATA key in response")
+}
+
+//finish consumes the end of the row array and any keys that follow it
+func (it *RowIterator) finish() error {
+	if _, err := it.dec.Token(); err != nil {
+		return fmt.Errorf("Error reading response: %v", err)
+	}
+	if !it.inObj {
+		return nil
+	}
+	return it.readRest()
+}
+
+//readRest consumes the keys that follow DATA and the end of the response object
+func (it *RowIterator) readRest() error {
+	for it.dec.More() {
+		key, err := it.readKey()
+		if err != nil {
+			return err
+		}
+		if err := it.readMeta(key); err != nil {
+			return err
+		}
+	}
+	_, err := it.dec.Token()
+	return err
+}
+
+func (it *RowIterator) readKey() (string, error) {
+	tok, err := it.dec.Token()
+	if err != nil {
+		return "", fmt.Errorf("Error reading response: %v", err)
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("Expected an object key, got %v", tok)
+	}
+	return key, nil
+}
+
+func (it *RowIterator) readMeta(key string) error {
+	var val interface{}
+	if err := it.dec.Decode(&val); err != nil {
+		return fmt.Errorf("Error decoding '%s': %v", key, err)
+	}
+	it.Meta[key] = val
+	return nil
+}
@@ -0,0 +1,300 @@
+package GoSDK
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqttTypes "github.com/clearblade/mqtt_parsing"
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+)
+
+const _DEFAULT_SUBSCRIPTION_BUFFER = 50
+
+//OverflowPolicy decides what happens to an incoming message when a subscription's buffer is full
+type OverflowPolicy int
+
+const (
+	//OverflowBlock waits for the consumer to make room. This stalls delivery for every subscription on the client.
+	OverflowBlock OverflowPolicy = iota
+	//OverflowDropOldest discards the oldest buffered message to make room for the new one
+	OverflowDropOldest
+	//OverflowDropNewest discards the incoming message
+	OverflowDropNewest
+)
+
+//SubscribeOptions configures the buffering of a subscription
+type SubscribeOptions struct {
+	//BufferSize is the number of messages held for the consumer. Defaults to 50.
+	BufferSize int
+	Overflow   OverflowPolicy
+}
+
+//MessageHandler is called, in order, for each message received on a handler-based subscription
+type MessageHandler func(*mqttTypes.Publish)
+
+//SubscriptionStats counts the messages that went through a subscription
+type SubscriptionStats struct {
+	Received  uint64
+	Delivered uint64
+	Dropped   uint64
+}
+
+//Subscription is a single topic subscription. Its channel is closed when the topic is unsubscribed
+//or the client disconnects.
+type Subscription struct {
+	Topic     string
+	Qos       int
+	ch        chan *mqttTypes.Publish
+	done      chan struct{}
+	overflow  OverflowPolicy
+	handler   MessageHandler
+	callback  mqtt.MessageHandler
+	lock      sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	received  uint64
+	delivered uint64
+	dropped   uint64
+	client    MqttClient
+}
+
+//Messages returns the channel messages are delivered on. It is nil for handler-based subscriptions.
+func (s *Subscription) Messages() <-chan *mqttTypes.Publish {
+	if s.handler != nil {
+		return nil
+	}
+	return s.ch
+}
+
+//Stats returns a snapshot of the subscription's message counts
+func (s *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Received:  atomic.LoadUint64(&s.received),
+		Delivered: atomic.LoadUint64(&s.delivered),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+	}
+}
+
+//Unsubscribe removes the subscription from the broker and closes its channel
+func (s *Subscription) Unsubscribe() error {
+	return unsubscribe(s.client, s.Topic)
+}
+
+//SubscribeWithOptions subscribes to a topic with the given buffering options
+func (u *UserClient) SubscribeWithOptions(topic string, qos int, opts SubscribeOptions) (*Subscription, error) {
+	return subscribeWithOptions(u.guardedMqtt(), topic, qos, opts, nil)
+}
+
+//SubscribeWithOptions subscribes to a topic with the given buffering options
+func (d *DeviceClient) SubscribeWithOptions(topic string, qos int, opts SubscribeOptions) (*Subscription, error) {
+	return subscribeWithOptions(d.guardedMqtt(), topic, qos, opts, nil)
+}
+
+//SubscribeWithOptions subscribes to a topic with the given buffering options
+func (d *DevClient) SubscribeWithOptions(topic string, qos int, opts SubscribeOptions) (*Subscription, error) {
+	return subscribeWithOptions(d.MQTTClient, topic, qos, opts, nil)
+}
+
+//SubscribeWithHandler subscribes to a topic and calls handler for every message. The handler runs on its own
+//goroutine, so a slow handler only fills its own buffer rather than stalling the client.
+func (u *UserClient) SubscribeWithHandler(topic string, qos int, opts SubscribeOptions, handler MessageHandler) (*Subscription, error) {
+	return subscribeWithOptions(u.guardedMqtt(), topic, qos, opts, handler)
+}
+
+//SubscribeWithHandler subscribes to a topic and calls handler for every message. The handler runs on its own
+//goroutine, so a slow handler only fills its own buffer rather than stalling the client.
+func (d *DeviceClient) SubscribeWithHandler(topic string, qos int, opts SubscribeOptions, handler MessageHandler) (*Subscription, error) {
+	return subscribeWithOptions(d.guardedMqtt(), topic, qos, opts, handler)
+}
+
+//SubscribeWithHandler subscribes to a topic and calls handler for every message. The handler runs on its own
+//goroutine, so a slow handler only fills its own buffer rather than stalling the client.
+func (d *DevClient) SubscribeWithHandler(topic string, qos int, opts SubscribeOptions, handler MessageHandler) (*Subscription, error) {
+	return subscribeWithOptions(d.MQTTClient, topic, qos, opts, handler)
+}
+
+func subscribeWithOptions(c MqttClient, topic string, qos int, opts SubscribeOptions, handler MessageHandler) (*Subscription, error) {
+	if c == nil {
+		return nil, errors.New("MQTTClient is uninitialized")
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = _DEFAULT_SUBSCRIPTION_BUFFER
+	}
+	sub := &Subscription{
+		Topic:    topic,
+		Qos:      qos,
+		ch:       make(chan *mqttTypes.Publish, size),
+		done:     make(chan struct{}),
+		overflow: opts.Overflow,
+		handler:  handler,
+		client:   c,
+	}
+	if handler != nil {
+		go func() {
+			for msg := range sub.ch {
+				handler(msg)
+			}
+		}()
+	}
+	sub.callback = func(client mqtt.Client, msg mqtt.Message) {
+		sub.deliver(newPublish(msg))
+	}
+	ret := c.Subscribe(topic, uint8(qos), sub.callback)
+	ret.WaitTimeout(1 * time.Second)
+	if err := ret.Error(); err != nil {
+		sub.close()
+		return nil, err
+	}
+	subscriptionsFor(c).add(sub)
+	return sub, nil
+}
+
+func newPublish(msg mqtt.Message) *mqttTypes.Publish {
+	path, _ := mqttTypes.NewTopicPath(msg.Topic())
+	return &mqttTypes.Publish{
+		Header: &mqttTypes.StaticHeader{
+			DUP:    msg.Duplicate(),
+			Retain: msg.Retained(),
+			QOS:    msg.Qos(),
+		},
+		Topic:     path,
+		MessageId: msg.MessageID(),
+		Payload:   msg.Payload(),
+	}
+}
+
+//deliver is called from the mqtt client's routing goroutine, and applies the overflow policy
+func (s *Subscription) deliver(msg *mqttTypes.Publish) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	atomic.AddUint64(&s.received, 1)
+	switch s.overflow {
+	case OverflowDropNewest:
+		select {
+		case s.ch <- msg:
+			atomic.AddUint64(&s.delivered, 1)
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				atomic.AddUint64(&s.delivered, 1)
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.delivered, ^uint64(0))
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- msg:
+			atomic.AddUint64(&s.delivered, 1)
+		case <-s.done:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+//close stops delivery and closes the subscription's channel. It is safe to call more than once.
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		s.closed = true
+		close(s.ch)
+		s.lock.Unlock()
+	})
+}
+
+//subscriptionRegistry tracks the live subscriptions of one mqtt connection
+type subscriptionRegistry struct {
+	lock sync.Mutex
+	subs map[string]*Subscription
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{subs: map[string]*Subscription{}}
+}
+
+//add records sub, closing any previous subscription to the same topic since the broker routes to only one of them
+func (r *subscriptionRegistry) add(sub *Subscription) {
+	r.lock.Lock()
+	old := r.subs[sub.Topic]
+	r.subs[sub.Topic] = sub
+	r.lock.Unlock()
+	if old != nil && old != sub {
+		old.close()
+	}
+}
+
+func (r *subscriptionRegistry) remove(topic string) {
+	r.lock.Lock()
+	sub := r.subs[topic]
+	remaining := make(map[string]*Subscription, len(r.subs))
+	for t, other := range r.subs {
+		if t != topic {
+			remaining[t] = other
+		}
+	}
+	r.subs = remaining
+	r.lock.Unlock()
+	if sub != nil {
+		sub.close()
+	}
+}
+
+func (r *subscriptionRegistry) removeAll() {
+	r.lock.Lock()
+	subs := r.subs
+	r.subs = map[string]*Subscription{}
+	r.lock.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+func (r *subscriptionRegistry) list() []*Subscription {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rval := make([]*Subscription, 0, len(r.subs))
+	for _, sub := range r.subs {
+		rval = append(rval, sub)
+	}
+	return rval
+}
+
+//foreignSubs maps an MqttClient to its *subscriptionRegistry. It is a sync.Map
+//because this package's delete helper shadows the builtin.
+var foreignSubs sync.Map
+
+//subscriptionsFor returns the registry of an mqtt connection. Clients created by this package carry their own,
+//clients handed to SetMqttClient get one kept here until they are disconnected.
+func subscriptionsFor(c MqttClient) *subscriptionRegistry {
+	if g, ok := c.(*guardedMqttClient); ok {
+		c = g.MqttClient
+	}
+	if b, ok := c.(*mqttBaseClient); ok {
+		return b.subs
+	}
+	r, _ := foreignSubs.LoadOrStore(c, newSubscriptionRegistry())
+	return r.(*subscriptionRegistry)
+}
+
+func forgetSubscriptions(c MqttClient) {
+	subscriptionsFor(c).removeAll()
+	if _, ok := c.(*mqttBaseClient); !ok {
+		foreignSubs.Delete(c)
+	}
+}
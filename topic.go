@@ -0,0 +1,115 @@
+package GoSDK
+
+import (
+	"fmt"
+	"strings"
+)
+
+//This file holds the mqtt topic filter semantics shared by the router, the permission guard and the
+//other helpers that need to reason about topics without asking the broker.
+
+//splitTopic breaks a topic or topic filter into its levels. Leading, trailing and repeated
+//separators make empty levels, which are significant to the broker: "a/b" and "/a/b" are different topics.
+func splitTopic(topic string) []string {
+	return strings.Split(topic, "/")
+}
+
+//ValidateTopicFilter checks that filter is a legal mqtt subscription filter:
+//'+' and '#' must occupy a whole level, and '#' must be the last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("Topic filter is empty")
+	}
+	levels := splitTopic(filter)
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return fmt.Errorf("Invalid topic filter '%s': '#' must be the last level", filter)
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "+#"):
+			return fmt.Errorf("Invalid topic filter '%s': wildcards must occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+//ValidateTopicName checks that topic is a legal topic to publish to, that is, it has no wildcards
+func ValidateTopicName(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("Topic is empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("Invalid topic '%s': wildcards are not allowed when publishing", topic)
+	}
+	return nil
+}
+
+//TopicMatches reports whether topic matches the mqtt topic filter
+func TopicMatches(filter, topic string) bool {
+	_, ok := matchTopicLevels(splitTopic(filter), splitTopic(topic))
+	return ok
+}
+
+//matchTopicLevels matches topic against filter. On success it returns the index of the first topic
+//level consumed by a trailing '#', or len(topic) if the filter has none.
+func matchTopicLevels(filter, topic []string) (int, bool) {
+	if len(topic) > 0 && strings.HasPrefix(topic[0], "$") && len(filter) > 0 && (filter[0] == "+" || filter[0] == "#") {
+		return 0, false
+	}
+	for i, level := range filter {
+		if level == "#" {
+			return i, true
+		}
+		if i >= len(topic) {
+			return 0, false
+		}
+		if level != "+" && level != topic[i] {
+			return 0, false
+		}
+	}
+	return len(topic), len(filter) == len(topic)
+}
+
+//TopicFilterCovers reports whether every topic matched by inner is also matched by outer
+func TopicFilterCovers(outer, inner string) bool {
+	return filterCovers(splitTopic(outer), splitTopic(inner))
+}
+
+func filterCovers(outer, inner []string) bool {
+	for i, level := range outer {
+		if level == "#" {
+			return true
+		}
+		if i >= len(inner) || inner[i] == "#" {
+			return false
+		}
+		if level != "+" && level != inner[i] {
+			return false
+		}
+	}
+	return len(outer) == len(inner)
+}
+
+//filtersOverlap reports whether some topic is matched by both filters
+func filtersOverlap(a, b string) bool {
+	la, lb := splitTopic(a), splitTopic(b)
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if la[i] == "#" || lb[i] == "#" {
+			return true
+		}
+		if la[i] != "+" && lb[i] != "+" && la[i] != lb[i] {
+			return false
+		}
+	}
+	switch {
+	case len(la) == len(lb):
+		return true
+	case len(la) == len(lb)+1:
+		return la[len(lb)] == "#"
+	case len(lb) == len(la)+1:
+		return lb[len(la)] == "#"
+	}
+	return false
+}
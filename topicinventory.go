@@ -0,0 +1,329 @@
+package GoSDK
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_TOPIC_INVENTORY_PAGE_SIZE = 100
+	_TOPIC_CHANGES_BUFFER      = 10
+
+	//the topic column of a row of the topics endpoint, which the rows are sorted by
+	_TOPIC_COLUMN_TOPIC = "topicid"
+)
+
+//TopicRecord is a topic currently known to the broker. Only the topic column is read, whatever
+//else the platform returns for it is left in Raw.
+type TopicRecord struct {
+	Topic string
+	//Raw is the record as returned by the platform
+	Raw map[string]interface{}
+}
+
+//TopicInventory returns a record for every current topic of the system
+func (u *UserClient) TopicInventory(systemKey string) ([]*TopicRecord, error) {
+	return topicInventory(u, systemKey)
+}
+
+//TopicInventory returns a record for every current topic of the system
+func (d *DevClient) TopicInventory(systemKey string) ([]*TopicRecord, error) {
+	return topicInventory(d, systemKey)
+}
+
+//TopicCount returns the number of current topics of the system
+func (u *UserClient) TopicCount(systemKey string) (int, error) {
+	return topicCount(u, systemKey)
+}
+
+//TopicCount returns the number of current topics of the system
+func (d *DevClient) TopicCount(systemKey string) (int, error) {
+	return topicCount(d, systemKey)
+}
+
+//WatchTopics takes a snapshot of the system's topics every interval and sends the changes between snapshots
+func (u *UserClient) WatchTopics(systemKey string, interval time.Duration) (*TopicWatcher, error) {
+	return newTopicWatcher(func() ([]*TopicRecord, error) { return topicInventory(u, systemKey) }, interval)
+}
+
+//WatchTopics takes a snapshot of the system's topics every interval and sends the changes between snapshots
+func (d *DevClient) WatchTopics(systemKey string, interval time.Duration) (*TopicWatcher, error) {
+	return newTopicWatcher(func() ([]*TopicRecord, error) { return topicInventory(d, systemKey) }, interval)
+}
+
+func topicInventory(c cbClient, systemKey string) ([]*TopicRecord, error) {
+	var records []*TopicRecord
+	for page := 1; ; page++ {
+		rows, err := getMqttTopicsWithQuery(c, systemKey, nil, _TOPIC_INVENTORY_PAGE_SIZE, page, false)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting topics: %v", err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			rec, err := newTopicRecord(row)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func topicCount(c cbClient, systemKey string) (int, error) {
+	body, err := getMqttTopicsCount(c, systemKey)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := body["count"]
+	if !ok {
+		return 0, fmt.Errorf("Topic count not present in response from platform %+v", body)
+	}
+	n, err := toInt64(v)
+	if err != nil {
+		return 0, fmt.Errorf("Bad topic count: %v", err)
+	}
+	return int(n), nil
+}
+
+//newTopicRecord reads a row of the topics endpoint
+func newTopicRecord(row map[string]interface{}) (*TopicRecord, error) {
+	rec := &TopicRecord{Raw: row}
+	rec.Topic, _ = row[_TOPIC_COLUMN_TOPIC].(string)
+	if rec.Topic == "" {
+		return nil, fmt.Errorf("Topic record without a topic: %+v", row)
+	}
+	return rec, nil
+}
+
+//TopicNode is a level of a topic tree. Record is set when the path down to the node is itself a topic.
+type TopicNode struct {
+	Segment  string
+	Path     string
+	Record   *TopicRecord
+	Children map[string]*TopicNode
+}
+
+//BuildTopicTree groups records into a tree by topic level. The root has an empty Segment and Path.
+func BuildTopicTree(records []*TopicRecord) *TopicNode {
+	root := &TopicNode{Children: map[string]*TopicNode{}}
+	for _, rec := range records {
+		node := root
+		for _, segment := range splitTopic(rec.Topic) {
+			child, ok := node.Children[segment]
+			if !ok {
+				path := segment
+				if node != root {
+					path = node.Path + "/" + segment
+				}
+				child = &TopicNode{
+					Segment:  segment,
+					Path:     path,
+					Children: map[string]*TopicNode{},
+				}
+				node.Children[segment] = child
+			}
+			node = child
+		}
+		node.Record = rec
+	}
+	return root
+}
+
+//Find returns the node for path below n, or nil. An empty path is n itself.
+func (n *TopicNode) Find(path string) *TopicNode {
+	if path == "" {
+		return n
+	}
+	node := n
+	for _, segment := range splitTopic(path) {
+		node = node.Children[segment]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+//Topics returns the number of topics at or below the node
+func (n *TopicNode) Topics() int {
+	count := 0
+	n.Walk(func(node *TopicNode) bool {
+		if node.Record != nil {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+//Walk visits the node and its descendants depth first, children in segment order. Returning false from fn skips a node's children.
+func (n *TopicNode) Walk(fn func(*TopicNode) bool) {
+	if !fn(n) {
+		return
+	}
+	segments := make([]string, 0, len(n.Children))
+	for segment := range n.Children {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		n.Children[segment].Walk(fn)
+	}
+}
+
+//String renders the tree one level per line, for logging
+func (n *TopicNode) String() string {
+	var b strings.Builder
+	depth := map[*TopicNode]int{n: -1}
+	n.Walk(func(node *TopicNode) bool {
+		for _, child := range node.Children {
+			depth[child] = depth[node] + 1
+		}
+		if node.Segment == "" {
+			return true
+		}
+		b.WriteString(strings.Repeat("  ", depth[node]))
+		b.WriteString(node.Segment)
+		b.WriteString("\n")
+		return true
+	})
+	return b.String()
+}
+
+//TopicSnapshot is the topic inventory at a point in time
+type TopicSnapshot struct {
+	Time   time.Time
+	Topics map[string]*TopicRecord
+}
+
+//NewTopicSnapshot indexes records by topic
+func NewTopicSnapshot(records []*TopicRecord) *TopicSnapshot {
+	s := &TopicSnapshot{
+		Time:   time.Now(),
+		Topics: make(map[string]*TopicRecord, len(records)),
+	}
+	for _, rec := range records {
+		s.Topics[rec.Topic] = rec
+	}
+	return s
+}
+
+//TopicChanges describes how the inventory changed between two snapshots
+type TopicChanges struct {
+	Previous *TopicSnapshot
+	Current  *TopicSnapshot
+	//Appeared holds the topics that were not in the previous snapshot
+	Appeared []*TopicRecord
+	//Disappeared holds the topics of the previous snapshot that are gone
+	Disappeared []*TopicRecord
+	//Err is set when a snapshot could not be taken. The other fields are then empty.
+	Err error
+}
+
+//Diff compares the snapshot with an earlier one
+func (s *TopicSnapshot) Diff(previous *TopicSnapshot) *TopicChanges {
+	changes := &TopicChanges{Previous: previous, Current: s}
+	for topic, rec := range s.Topics {
+		if _, ok := previous.Topics[topic]; !ok {
+			changes.Appeared = append(changes.Appeared, rec)
+		}
+	}
+	for topic, rec := range previous.Topics {
+		if _, ok := s.Topics[topic]; !ok {
+			changes.Disappeared = append(changes.Disappeared, rec)
+		}
+	}
+	sortTopicRecords(changes.Appeared)
+	sortTopicRecords(changes.Disappeared)
+	return changes
+}
+
+//Empty reports whether nothing changed
+func (c *TopicChanges) Empty() bool {
+	return c.Err == nil && len(c.Appeared) == 0 && len(c.Disappeared) == 0
+}
+
+func sortTopicRecords(records []*TopicRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Topic < records[j].Topic
+	})
+}
+
+//TopicWatcher polls the topic inventory and reports changes between polls
+type TopicWatcher struct {
+	changes  chan *TopicChanges
+	stop     chan struct{}
+	stopOnce sync.Once
+	lock     sync.Mutex
+	latest   *TopicSnapshot
+}
+
+func newTopicWatcher(fetch func() ([]*TopicRecord, error), interval time.Duration) (*TopicWatcher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("Topic watch interval must be positive, got %v", interval)
+	}
+	w := &TopicWatcher{
+		changes: make(chan *TopicChanges, _TOPIC_CHANGES_BUFFER),
+		stop:    make(chan struct{}),
+	}
+	go w.run(fetch, interval)
+	return w, nil
+}
+
+//Changes returns the channel changes are sent on. Polls where nothing changed are not sent.
+//The channel is closed by Stop.
+func (w *TopicWatcher) Changes() <-chan *TopicChanges {
+	return w.changes
+}
+
+//Latest returns the most recent snapshot, or nil before the first poll completes
+func (w *TopicWatcher) Latest() *TopicSnapshot {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.latest
+}
+
+//Stop ends polling
+func (w *TopicWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *TopicWatcher) run(fetch func() ([]*TopicRecord, error), interval time.Duration) {
+	defer close(w.changes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		records, err := fetch()
+		var changes *TopicChanges
+		if err != nil {
+			changes = &TopicChanges{Err: err}
+		} else {
+			snap := NewTopicSnapshot(records)
+			w.lock.Lock()
+			previous := w.latest
+			w.latest = snap
+			w.lock.Unlock()
+			if previous != nil {
+				changes = snap.Diff(previous)
+			}
+		}
+		if changes != nil && !changes.Empty() {
+			select {
+			case w.changes <- changes:
+			case <-w.stop:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -78,8 +78,11 @@ func (u *UserClient) GetUserCount(systemKey string) (int, error) {
 		return -1, fmt.Errorf("Error getting count: %v", resp.Body)
 	}
 	bod := resp.Body.(map[string]interface{})
-	theCount := int(bod["count"].(float64))
-	return theCount, nil
+	theCount, err := toFloat64(bod["count"])
+	if err != nil {
+		return -1, fmt.Errorf("Error getting count: %v", err)
+	}
+	return int(theCount), nil
 }
 
 func (d *DevClient) GetUserCountWithQuery(systemKey string, query *Query) (CountResp, error) {
@@ -103,8 +106,12 @@ func (d *DevClient) GetUserCountWithQuery(systemKey string, query *Query) (Count
 		return CountResp{Count: 0}, fmt.Errorf("Bad type returned by getDevicesCount: %T, %s", resp.Body, resp.Body.(string))
 	}
 
+	count, err := toFloat64(rval["count"])
+	if err != nil {
+		return CountResp{Count: 0}, err
+	}
 	return CountResp{
-		Count: rval["count"].(float64),
+		Count: count,
 	}, nil
 }
 
@@ -111,10 +111,18 @@ type cbClient interface {
 	getHttpAddr() string
 	getMqttAddr() string
 	getEdgeProxy() *EdgeProxy
+	decodesNumbers() bool
+	httpTransport() *http.Transport
 }
 
 // receiver for methods that can be shared between users/devs/devices
-type client struct{}
+type client struct {
+	useNumber   bool
+	mqttVersion uint
+	transport   *http.Transport
+	webSocket   *WebSocketOptions
+	session     *MqttSessionOptions
+}
 
 //UserClient is the type for users
 type UserClient struct {
@@ -131,6 +139,8 @@ type UserClient struct {
 	MqttAddr     string
 	MqttAuthAddr string
 	edgeProxy    *EdgeProxy
+	offlineQueue *OfflineQueue
+	topicGuard   *TopicPermissions
 }
 
 type DeviceClient struct {
@@ -147,6 +157,10 @@ type DeviceClient struct {
 	MqttAddr     string
 	MqttAuthAddr string
 	edgeProxy    *EdgeProxy
+	offlineQueue *OfflineQueue
+	clientCert   *ClientCertificate
+	clientTLS    *tls.Config
+	topicGuard   *TopicPermissions
 }
 
 //DevClient is the type for developers
@@ -785,6 +799,46 @@ func logout(c cbClient) error {
 }
 
 func do(c cbClient, r *CbReq, creds [][]string) (*CbResp, error) {
+	resp, err := doRaw(c, r, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, fmt.Errorf("Error Reading Response Body: %v", readErr)
+	}
+	var d interface{}
+	if len(body) == 0 {
+		return &CbResp{
+			Body:       nil,
+			StatusCode: resp.StatusCode,
+		}, nil
+	}
+	buf := bytes.NewBuffer(body)
+	dec := newDecoder(c, json.NewDecoder(buf))
+	decErr := dec.Decode(&d)
+	var bod interface{}
+	if decErr != nil {
+		//		return nil, fmt.Errorf("JSON Decoding Error: %v\n With Body: %v\n", decErr, string(body))
+		bod = string(body)
+	}
+	switch d.(type) {
+	case []interface{}:
+		bod = d
+	case map[string]interface{}:
+		bod = d
+	default:
+		bod = string(body)
+	}
+	return &CbResp{
+		Body:       bod,
+		StatusCode: resp.StatusCode,
+	}, nil
+}
+
+//doRaw sends the request and hands back the unread response, the caller must close the body
+func doRaw(c cbClient, r *CbReq, creds [][]string) (*http.Response, error) {
 	checkForEdgeProxy(c, r)
 	var bodyToSend *bytes.Buffer
 	if r.Body != nil {
@@ -824,45 +878,14 @@ func do(c cbClient, r *CbReq, creds [][]string) (*CbResp, error) {
 	}
 
 	cli := &http.Client{
-		Transport: tr,
+		Transport: c.httpTransport(),
 		Timeout:   time.Minute * 5,
 	}
 	resp, err := cli.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Error Making Request: %v", err)
 	}
-	defer resp.Body.Close()
-	body, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, fmt.Errorf("Error Reading Response Body: %v", readErr)
-	}
-	var d interface{}
-	if len(body) == 0 {
-		return &CbResp{
-			Body:       nil,
-			StatusCode: resp.StatusCode,
-		}, nil
-	}
-	buf := bytes.NewBuffer(body)
-	dec := json.NewDecoder(buf)
-	decErr := dec.Decode(&d)
-	var bod interface{}
-	if decErr != nil {
-		//		return nil, fmt.Errorf("JSON Decoding Error: %v\n With Body: %v\n", decErr, string(body))
-		bod = string(body)
-	}
-	switch d.(type) {
-	case []interface{}:
-		bod = d
-	case map[string]interface{}:
-		bod = d
-	default:
-		bod = string(body)
-	}
-	return &CbResp{
-		Body:       bod,
-		StatusCode: resp.StatusCode,
-	}, nil
+	return resp, nil
 }
 
 //standard http verbs
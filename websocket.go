@@ -0,0 +1,237 @@
+package GoSDK
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	mqtt "github.com/clearblade/paho.mqtt.golang"
+	"golang.org/x/net/websocket"
+)
+
+const _DEFAULT_WEBSOCKET_PATH = "/mqtt"
+
+//WebSocketOptions makes InitializeMQTT and AuthenticateMQTT reach the broker over ws://, or wss:// when
+//a tls config is passed, instead of tcp:// and tls://. MqttAddr and MqttAuthAddr should then hold the
+//broker's websocket listeners, as returned by EdgeConfig.WebSocketAddrs for an edge.
+type WebSocketOptions struct {
+	//Path is the http path of the broker's websocket endpoint. Defaults to "/mqtt".
+	Path string
+	//AuthPath is the path used by AuthenticateMQTT. Defaults to Path.
+	AuthPath string
+	//Header is sent with the websocket upgrade request, for proxies that need extra headers
+	Header http.Header
+}
+
+//UseWebSockets makes later calls to InitializeMQTT and AuthenticateMQTT connect over websockets. Passing nil goes back to tcp.
+func (u *UserClient) UseWebSockets(opts *WebSocketOptions) {
+	u.webSocket = opts
+}
+
+//UseWebSockets makes later calls to InitializeMQTT and AuthenticateMQTT connect over websockets. Passing nil goes back to tcp.
+func (d *DeviceClient) UseWebSockets(opts *WebSocketOptions) {
+	d.webSocket = opts
+}
+
+//UseWebSockets makes later calls to InitializeMQTT and AuthenticateMQTT connect over websockets. Passing nil goes back to tcp.
+func (d *DevClient) UseWebSockets(opts *WebSocketOptions) {
+	d.webSocket = opts
+}
+
+//brokerURL builds the url of the broker at address. An address that already has a scheme is used as is.
+func brokerURL(address string, ssl *tls.Config, ws *WebSocketOptions, auth bool) (*url.URL, error) {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid broker address '%s': %v", address, err)
+		}
+		return u, nil
+	}
+	if ws == nil {
+		if ssl != nil {
+			return &url.URL{Scheme: "tls", Host: address}, nil
+		}
+		return &url.URL{Scheme: "tcp", Host: address}, nil
+	}
+	path := ws.Path
+	if auth && ws.AuthPath != "" {
+		path = ws.AuthPath
+	}
+	if path == "" {
+		path = _DEFAULT_WEBSOCKET_PATH
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if ssl != nil {
+		return &url.URL{Scheme: "wss", Host: address, Path: path}, nil
+	}
+	return &url.URL{Scheme: "ws", Host: address, Path: path}, nil
+}
+
+//setBroker points o at the broker. The mqtt library cannot send custom headers on the websocket upgrade,
+//so when there are any the client connects to a local bridge that dials the websocket itself.
+//The returned closer, if any, shuts the bridge down.
+func setBroker(o *mqtt.ClientOptions, address string, ssl *tls.Config, ws *WebSocketOptions, auth bool) (io.Closer, error) {
+	u, err := brokerURL(address, ssl, ws, auth)
+	if err != nil {
+		return nil, err
+	}
+	isWebSocket := u.Scheme == "ws" || u.Scheme == "wss"
+	if !isWebSocket || ws == nil || len(ws.Header) == 0 {
+		o.AddBroker(u.String())
+		if ssl != nil {
+			o.SetTLSConfig(ssl)
+		}
+		return nil, nil
+	}
+	bridge, err := newWebSocketBridge(u, ssl, ws.Header)
+	if err != nil {
+		return nil, err
+	}
+	//the mqtt library dials unix urls with their host as the socket path, without parsing it again
+	o.Servers = append(o.Servers, &url.URL{Scheme: "unix", Host: bridge.path})
+	return bridge, nil
+}
+
+//webSocketBridge relays the mqtt client's connection over a websocket carrying the custom headers.
+//It listens on a unix socket in a directory only the current user can open, since whoever connects
+//to it reaches the broker with those headers, and it relays one connection at a time: the next one
+//is only accepted when the client reconnects after the previous one ended.
+type webSocketBridge struct {
+	listener  net.Listener
+	dir       string
+	path      string
+	config    *websocket.Config
+	lock      sync.Mutex
+	active    net.Conn
+	closed    bool
+	closeOnce sync.Once
+}
+
+//webSocketConfig configures a websocket to the broker at u carrying header
+func webSocketConfig(u *url.URL, ssl *tls.Config, header http.Header) (*websocket.Config, error) {
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring websocket: %v", err)
+	}
+	config.Protocol = []string{"mqtt"}
+	config.TlsConfig = ssl
+	for k, v := range header {
+		config.Header[k] = append([]string{}, v...)
+	}
+	return config, nil
+}
+
+func newWebSocketBridge(u *url.URL, ssl *tls.Config, header http.Header) (*webSocketBridge, error) {
+	config, err := webSocketConfig(u, ssl, header)
+	if err != nil {
+		return nil, err
+	}
+	//TempDir creates the directory with mode 0700
+	dir, err := ioutil.TempDir("", "cbws")
+	if err != nil {
+		return nil, fmt.Errorf("Error starting websocket bridge: %v", err)
+	}
+	path := filepath.Join(dir, "mqtt.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Error starting websocket bridge: %v", err)
+	}
+	b := &webSocketBridge{listener: l, dir: dir, path: path, config: config}
+	go b.serve()
+	return b, nil
+}
+
+func (b *webSocketBridge) serve() {
+	for {
+		local, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.relay(local)
+	}
+}
+
+func (b *webSocketBridge) relay(local net.Conn) {
+	defer local.Close()
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.active = local
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.active = nil
+		b.lock.Unlock()
+	}()
+	remote, err := websocket.DialConfig(b.config)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	remote.PayloadType = websocket.BinaryFrame
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+//Close stops accepting connections and ends the one being relayed
+func (b *webSocketBridge) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		err = b.listener.Close()
+		b.lock.Lock()
+		b.closed = true
+		if b.active != nil {
+			b.active.Close()
+		}
+		b.lock.Unlock()
+		os.RemoveAll(b.dir)
+	})
+	return err
+}
+
+//WebSocketAddrs returns the addresses of the websocket listeners of an edge started from e, on e.Host, to use as
+//MqttAddr and MqttAuthAddr together with UseWebSockets. With secure, mqttAddr is the WssPort listener.
+//authAddr is empty when AuthWsPort isn't set.
+func (e EdgeConfig) WebSocketAddrs(secure bool) (mqttAddr, authAddr string, err error) {
+	port := e.WsPort
+	if secure {
+		port = e.WssPort
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("The edge config has no websocket port")
+	}
+	host := e.Host
+	if host == "" {
+		host = "localhost"
+	}
+	mqttAddr = net.JoinHostPort(host, port)
+	if e.AuthWsPort != "" {
+		authAddr = net.JoinHostPort(host, e.AuthWsPort)
+	}
+	return mqttAddr, authAddr, nil
+}